@@ -0,0 +1,122 @@
+// Package agefile converts between mail payloads and age encrypted files
+// (https://age-encryption.org), so data can be handed to people who use
+// age instead of a maildepot client.
+package agefile
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+)
+
+// MaxSize is the largest payload that Decrypt will read.
+var MaxSize int64 = 16 << 20
+
+// PublicKey will return the keypair public key of a recipient, which can
+// be either an age1 recipient or already a public key.
+func PublicKey(recipient string) (publicKey string, err error) {
+	kp, err := parse(recipient)
+	if err != nil {
+		return
+	}
+	publicKey = kp.Public
+	return
+}
+
+func parse(recipient string) (kp keypair.KeyPair, err error) {
+	if strings.HasPrefix(recipient, "age1") {
+		return keypair.NewFromAge(recipient)
+	}
+	return keypair.NewFromPublic(recipient)
+}
+
+// Encrypt will write the payload as an age file to the recipients, which
+// can be age1 recipients or public keys.
+func Encrypt(w io.Writer, payload []byte, recipients ...string) (err error) {
+	if len(recipients) == 0 {
+		return errors.New("no recipients")
+	}
+	ageRecipients := make([]age.Recipient, len(recipients))
+	for i, recipient := range recipients {
+		var kp keypair.KeyPair
+		kp, err = parse(recipient)
+		if err != nil {
+			return errors.Wrap(err, recipient)
+		}
+		var s string
+		s, err = kp.AgeRecipient()
+		if err != nil {
+			return
+		}
+		ageRecipients[i], err = age.ParseX25519Recipient(s)
+		if err != nil {
+			return
+		}
+	}
+	wc, err := age.Encrypt(w, ageRecipients...)
+	if err != nil {
+		return
+	}
+	if _, err = wc.Write(payload); err != nil {
+		return
+	}
+	return wc.Close()
+}
+
+// Export will write the payload of an opened message as an age file.
+func Export(w io.Writer, om mail.OpenMessage, recipients ...string) error {
+	return Encrypt(w, om.MessageBytes, recipients...)
+}
+
+// Decrypt will read an age file with any of the keys.
+func Decrypt(r io.Reader, mykeys ...keypair.KeyPair) (payload []byte, err error) {
+	identities := make([]age.Identity, 0, len(mykeys))
+	for _, kp := range mykeys {
+		var s string
+		s, err = kp.AgeIdentity()
+		if err != nil {
+			return
+		}
+		var identity *age.X25519Identity
+		identity, err = age.ParseX25519Identity(s)
+		if err != nil {
+			return
+		}
+		identities = append(identities, identity)
+	}
+	pr, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return
+	}
+	payload, err = ioutil.ReadAll(io.LimitReader(pr, MaxSize+1))
+	if err != nil {
+		return
+	}
+	if int64(len(payload)) > MaxSize {
+		err = errors.Errorf("age file is larger than %d bytes", MaxSize)
+	}
+	return
+}
+
+// Import will read an age file with any of the keys and wrap the payload
+// into a message from the sender to the recipients.
+func Import(world keypair.KeyPair, sender keypair.KeyPair, mykeys []keypair.KeyPair, recipients []string, r io.Reader, opts ...mail.Option) (m mail.Message, err error) {
+	payload, err := Decrypt(r, mykeys...)
+	if err != nil {
+		return
+	}
+	publicKeys := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		publicKeys[i], err = PublicKey(recipient)
+		if err != nil {
+			err = errors.Wrap(err, recipient)
+			return
+		}
+	}
+	return mail.New(world, sender, publicKeys, payload, opts...)
+}
@@ -0,0 +1,89 @@
+package agefile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeys(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	kp, err := keypair.NewFromAge(identity.String())
+	assert.Nil(t, err)
+	recipient, err := kp.AgeRecipient()
+	assert.Nil(t, err)
+	assert.Equal(t, identity.Recipient().String(), recipient)
+	s, err := kp.AgeIdentity()
+	assert.Nil(t, err)
+	assert.Equal(t, identity.String(), s)
+
+	publicKey, err := PublicKey(recipient)
+	assert.Nil(t, err)
+	assert.Equal(t, kp.Public, publicKey)
+	_, err = PublicKey("age1notarecipient")
+	assert.NotNil(t, err)
+}
+
+func TestExport(t *testing.T) {
+	world, _ := keypair.New()
+	sender, _ := keypair.New()
+	bob, _ := keypair.New()
+	m, err := mail.New(world, sender, []string{bob.Public}, []byte("hello, world"))
+	assert.Nil(t, err)
+	om, err := m.Open(world, []keypair.KeyPair{bob})
+	assert.Nil(t, err)
+
+	// someone with only age gets the payload
+	identity, _ := age.GenerateX25519Identity()
+	var buf bytes.Buffer
+	assert.Nil(t, Export(&buf, om, identity.Recipient().String(), bob.Public))
+	r, err := age.Decrypt(bytes.NewReader(buf.Bytes()), identity)
+	assert.Nil(t, err)
+	payload, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello, world", string(payload))
+
+	// and so does bob with his key pair
+	payload, err = Decrypt(bytes.NewReader(buf.Bytes()), bob)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello, world", string(payload))
+
+	// but not when it is too large
+	defer func(size int64) { MaxSize = size }(MaxSize)
+	MaxSize = 5
+	_, err = Decrypt(bytes.NewReader(buf.Bytes()), bob)
+	assert.NotNil(t, err)
+}
+
+func TestImport(t *testing.T) {
+	world, _ := keypair.New()
+	sender, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	janeRecipient, _ := jane.AgeRecipient()
+
+	// an age file made with the age tools for bob
+	bobRecipient, _ := bob.AgeRecipient()
+	recipient, err := age.ParseX25519Recipient(bobRecipient)
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	assert.Nil(t, err)
+	w.Write([]byte("hello, world"))
+	assert.Nil(t, w.Close())
+
+	m, err := Import(world, sender, []keypair.KeyPair{bob}, []string{janeRecipient}, &buf)
+	assert.Nil(t, err)
+	om, err := m.Open(world, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello, world", string(om.MessageBytes))
+
+	_, err = Decrypt(bytes.NewReader(buf.Bytes()), jane)
+	assert.NotNil(t, err)
+}
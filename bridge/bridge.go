@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+)
+
+// bridgedBucket has the ID of every message the bridge has handled.
+const bridgedBucket = "bridged"
+
+// errRejected is returned when the destination refuses a message, which
+// does not change by sending it again.
+var errRejected = errors.New("relay rejected the message")
+
+// policy decides which messages are bridged and to whom.
+type policy struct {
+	// Routes maps the public key of a bridge key in the source world to
+	// the recipients in the destination world
+	Routes map[string][]string `json:"routes"`
+	// Senders are the senders that may use the bridge, everyone if empty
+	Senders []string `json:"senders,omitempty"`
+	// Stamp is the number of bits of work the destination requires
+	Stamp int `json:"stamp,omitempty"`
+}
+
+func (p policy) allowsSender(sender string) bool {
+	if len(p.Senders) == 0 {
+		return true
+	}
+	for _, s := range p.Senders {
+		if s == sender {
+			return true
+		}
+	}
+	return false
+}
+
+// relay is where messages are read from and sent to.
+type relay interface {
+	Messages() ([]mail.Message, error)
+	Send(mail.Message) error
+}
+
+// httpRelay talks to a relay over HTTP.
+type httpRelay struct {
+	url string
+}
+
+func (r httpRelay) Messages() (msgs []mail.Message, err error) {
+	resp, err := http.Get(r.url + "/all")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("relay returned %s", resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&msgs)
+	return
+}
+
+func (r httpRelay) Send(m mail.Message) (err error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	resp, err := http.Post(r.url+"/add", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("relay returned %s: %s", resp.Status, body)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			err = fmt.Errorf("%w: %s", errRejected, err)
+		}
+	}
+	return
+}
+
+// bridge re-wraps messages for its keys in one world for recipients in
+// another world. The bridged messages keep their ID, so a client that
+// gets a message from both worlds opens it once.
+type bridge struct {
+	from   keypair.KeyPair
+	to     keypair.KeyPair
+	keys   []keypair.KeyPair
+	policy policy
+	db     *depot.DB
+	source relay
+	dest   relay
+}
+
+// forward will bridge the messages that were not handled before and
+// returns how many were sent.
+func (b *bridge) forward() (sent int, err error) {
+	msgs, err := b.source.Messages()
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		id := m.ID()
+		var done bool
+		if b.db.Get(bridgedBucket, id, &done) == nil {
+			continue
+		}
+		var ok bool
+		ok, err = b.bridgeMessage(m)
+		if err != nil {
+			log.Printf("could not bridge %s: %s", id, err)
+			rejected := errors.Is(err, errRejected)
+			err = nil
+			if !rejected {
+				// it is tried again next time
+				continue
+			}
+		}
+		if err = b.db.Set(bridgedBucket, id, true); err != nil {
+			return
+		}
+		if ok {
+			sent++
+		}
+	}
+	return
+}
+
+// bridgeMessage sends the message to the destination if the policy allows
+// it. Messages that are not for the bridge are not an error.
+func (b *bridge) bridgeMessage(m mail.Message) (ok bool, err error) {
+	openMsg, err := m.Open(b.from, b.keys)
+	if errors.Is(err, mail.ErrNotForMe) || errors.Is(err, mail.ErrExpired) || errors.Is(err, mail.ErrWrongWorld) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	if !b.policy.allowsSender(openMsg.Sender) {
+		return false, nil
+	}
+	var recipients []string
+	seen := make(map[string]bool)
+	for _, key := range openMsg.Recipients {
+		for _, recipient := range b.policy.Routes[key.Public] {
+			if !seen[recipient] {
+				seen[recipient] = true
+				recipients = append(recipients, recipient)
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return false, nil
+	}
+
+	bridged, err := m.Rewrap(openMsg, b.to, recipients, mail.WithShuffledRecipients(), mail.WithStamp(b.policy.Stamp))
+	if err != nil {
+		return
+	}
+	err = b.dest.Send(bridged)
+	ok = err == nil
+	return
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRelay keeps the messages, or rejects them if it has no map.
+type fakeRelay struct {
+	msgs  map[string]mail.Message
+	sends int
+}
+
+func (r *fakeRelay) Messages() (msgs []mail.Message, err error) {
+	for _, m := range r.msgs {
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+func (r *fakeRelay) Send(m mail.Message) error {
+	if r.msgs == nil {
+		r.sends++
+		return errRejected
+	}
+	r.msgs[m.ID()] = m
+	return nil
+}
+
+func TestBridge(t *testing.T) {
+	os.Remove("bridge.db")
+	defer os.Remove("bridge.db")
+	db, err := depot.New("bridge.db")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.NewBucket(bridgedBucket))
+
+	world1, _ := keypair.New()
+	world2, _ := keypair.New()
+	bob, _ := keypair.New()
+	eve, _ := keypair.New()
+	janeProxy, _ := keypair.New()
+	jane, _ := keypair.New()
+
+	source := &fakeRelay{msgs: map[string]mail.Message{}}
+	dest := &fakeRelay{msgs: map[string]mail.Message{}}
+	b := &bridge{
+		from:   world1,
+		to:     world2,
+		keys:   []keypair.KeyPair{janeProxy},
+		policy: policy{Routes: map[string][]string{janeProxy.Public: {jane.Public}}, Senders: []string{bob.Public}},
+		db:     db,
+		source: source,
+		dest:   dest,
+	}
+
+	fromBob, _ := mail.New(world1, bob, []string{janeProxy.Public}, []byte("hello, jane"))
+	fromEve, _ := mail.New(world1, eve, []string{janeProxy.Public}, []byte("hello, jane"))
+	notForBridge, _ := mail.New(world1, bob, []string{bob.Public}, []byte("hello, bob"))
+	for _, m := range []mail.Message{fromBob, fromEve, notForBridge} {
+		source.Send(m)
+	}
+
+	sent, err := b.forward()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, sent)
+	bridged, ok := dest.msgs[fromBob.ID()]
+	assert.True(t, ok)
+	openMsg, err := bridged.Open(world2, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello, jane", string(openMsg.MessageBytes))
+	assert.Equal(t, bob.Public, openMsg.Sender)
+
+	// nothing is sent twice
+	sent, err = b.forward()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sent)
+
+	// rejected messages are not sent again
+	rejecting := &fakeRelay{}
+	b.dest = rejecting
+	again, _ := mail.New(world1, bob, []string{janeProxy.Public}, []byte("hello again, jane"))
+	source.Send(again)
+	for i := 0; i < 2; i++ {
+		sent, err = b.forward()
+		assert.Nil(t, err)
+		assert.Equal(t, 0, sent)
+	}
+	assert.Equal(t, 1, rejecting.sends)
+}
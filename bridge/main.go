@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/keypair"
+)
+
+func main() {
+	var fromURL, toURL, fromPassphrase, toPassphrase, keysFile, policyFile, dbName string
+	var interval time.Duration
+	flag.StringVar(&fromURL, "from", "http://localhost:8080", "relay of the source world")
+	flag.StringVar(&toURL, "to", "http://localhost:8081", "relay of the destination world")
+	flag.StringVar(&fromPassphrase, "from-world", "world1", "passphrase of the source world key")
+	flag.StringVar(&toPassphrase, "to-world", "world2", "passphrase of the destination world key")
+	flag.StringVar(&keysFile, "keys", "keys.json", "JSON file with the key pairs of the bridge in the source world")
+	flag.StringVar(&policyFile, "policy", "policy.json", "JSON file with the routes of the bridge")
+	flag.StringVar(&dbName, "db", "bridge.db", "depot database of bridged messages")
+	flag.DurationVar(&interval, "interval", time.Minute, "time between runs")
+	flag.Parse()
+
+	from, err := keypair.NewDeterministic(fromPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	to, err := keypair.NewDeterministic(toPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var keys []keypair.KeyPair
+	if err = readJSON(keysFile, &keys); err != nil {
+		log.Fatal(err)
+	}
+	for i := range keys {
+		keys[i], err = keypair.New(keys[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var p policy
+	if err = readJSON(policyFile, &p); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := depot.New(dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.NewBucket(bridgedBucket); err != nil {
+		log.Fatal(err)
+	}
+
+	b := &bridge{
+		from:   from,
+		to:     to,
+		keys:   keys,
+		policy: p,
+		db:     db,
+		source: httpRelay{fromURL},
+		dest:   httpRelay{toURL},
+	}
+	for {
+		sent, err := b.forward()
+		if err != nil {
+			log.Println(err)
+		} else if sent > 0 {
+			log.Printf("bridged %d messages", sent)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func readJSON(fname string, v interface{}) (err error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(b, v)
+}
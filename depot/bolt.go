@@ -24,15 +24,38 @@ type DB struct {
 	worldKey keypair.KeyPair
 	db       *bolt.DB
 	sync.RWMutex
+
+	// trees are the fingerprint trees of the buckets
+	trees   map[string]*tree
+	treesMu sync.Mutex
+
+	// logSize is the number of changes kept in the log of a bucket
+	logSize uint64
+
+	// node and clock make the versions of the values
+	node   string
+	clock  clock
+	merges map[string]MergeFunc
+
+	// wakes are closed at the next write to their bucket
+	wakes   map[string]chan struct{}
+	watchMu sync.Mutex
 }
 
 // New generates a new DDB
-func New(dbname string) (db *DB, err error) {
+func New(dbname string, opts ...Option) (db *DB, err error) {
 	db = new(DB)
 	db.worldKey, err = keypair.NewDeterministic("world1")
 	if err != nil {
 		return
 	}
+	db.node = randomNode()
+	db.logSize = DefaultLogSize
+	for _, opt := range opts {
+		if err = opt(db); err != nil {
+			return
+		}
+	}
 
 	db.db, err = bolt.Open(dbname, 0600, nil)
 	return
@@ -48,6 +71,9 @@ func (db *DB) NewBucket(bucket string) error {
 	db.Lock()
 	defer db.Unlock()
 	return db.db.Update(func(tx *bolt.Tx) error {
+		if _, err := logBucket(tx, bucket); err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
 		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
@@ -56,19 +82,27 @@ func (db *DB) NewBucket(bucket string) error {
 	})
 }
 
-// Set saves a value at the given key.
+// Set saves a value at the given key, as a new version of this node.
 func (db *DB) Set(bucket, key string, value interface{}) error {
 	db.Lock()
 	defer db.Unlock()
-	bValue, err := json.Marshal(value)
+	jsonValue, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
-	return db.db.Update(func(tx *bolt.Tx) error {
+	bValue := encodeVersioned(Versioned{Version: Version{db.clock.now(), db.node}, Value: jsonValue})
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		if _, err := db.appendLog(tx, bucket, []byte(key), bValue); err != nil {
+			return err
+		}
 		b := tx.Bucket([]byte(bucket))
-		err := b.Put([]byte(key), bValue)
-		return err
+		return b.Put([]byte(key), bValue)
 	})
+	if err == nil {
+		db.treeSet(bucket, key, bValue)
+		db.wake(bucket)
+	}
+	return err
 }
 
 // Get will return the value associated with a key.
@@ -81,52 +115,56 @@ func (db *DB) Get(bucket, key string, v interface{}) (err error) {
 		if val == nil {
 			return NoSuchKeyError{key}
 		}
-		return json.Unmarshal(val, &v)
+		versioned := decodeVersioned(val)
+		if versioned.Deleted {
+			return NoSuchKeyError{key}
+		}
+		return json.Unmarshal(versioned.Value, &v)
 	})
 }
 
-// Delete removes a key from the store.
+// Delete removes a key from the store, leaving a tombstone that sync
+// copies to the peers.
 func (db *DB) Delete(bucket, key string) error {
 	db.Lock()
 	defer db.Unlock()
-	return db.db.Update(func(tx *bolt.Tx) error {
+	tombstone := db.tombstone()
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		if _, err := db.appendLog(tx, bucket, []byte(key), tombstone); err != nil {
+			return err
+		}
 		b := tx.Bucket([]byte(bucket))
-		return b.Delete([]byte(key))
+		return b.Put([]byte(key), tombstone)
 	})
+	if err == nil {
+		db.treeSet(bucket, key, tombstone)
+		db.wake(bucket)
+	}
+	return err
 }
 
 // GetKeysInRange will return list of keys in that range
 func (db *DB) GetKeysInRange(bucket, first, last string) (keys []string, err error) {
-	db.RLock()
-	defer db.RUnlock()
-	keys = []string{}
-	err = db.db.View(func(tx *bolt.Tx) error {
-		// Assume our events bucket exists and has RFC3339 encoded time keys.
-		c := tx.Bucket([]byte(bucket)).Cursor()
-
-		// Our time range spans the 90's decade.
-		min := []byte(first)
-		max := []byte(last)
-
-		if first == "first" && last == "last" {
-			for k, _ := c.First(); k != nil; k, _ = c.Next() {
-				keys = append(keys, string(k))
-			}
-		} else if first == "first" {
-			for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
-				keys = append(keys, string(k))
-			}
-		} else if last == "last" {
-			for k, _ := c.Seek(min); k != nil; k, _ = c.Next() {
-				keys = append(keys, string(k))
-			}
-		} else {
-			for k, _ := c.Seek(min); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
-				keys = append(keys, string(k))
-			}
-		}
+	return db.keysInRange(bucket, first, last, false)
+}
 
-		return nil
-	})
-	return
+// eachInRange calls fn for the keys from first up to but not including
+// last, where "first" and "last" are the ends of the bucket, until fn
+// returns false.
+func eachInRange(c *bolt.Cursor, first, last string, fn func(k, v []byte) bool) {
+	var k, v []byte
+	if first == "first" {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek([]byte(first))
+	}
+	max := []byte(last)
+	for ; k != nil; k, v = c.Next() {
+		if last != "last" && bytes.Compare(k, max) >= 0 {
+			return
+		}
+		if !fn(k, v) {
+			return
+		}
+	}
 }
@@ -1,15 +1,29 @@
 package depot
 
 import (
-	"encoding/base64"
-	"encoding/binary"
+	"bytes"
+	"context"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"hash/adler32"
-	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mr-tron/base58/base58"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/schollz/maildepot/timeauthority/authtime"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/nacl/sign"
 )
 
 func TestDB(t *testing.T) {
@@ -60,78 +74,852 @@ func TestDB(t *testing.T) {
 	assert.True(t, isEqual)
 	assert.Nil(t, err)
 
-	fmt.Println(findExchange("test1", "first", "last", db, db2, []toExchange{}))
+	stats, err := Sync(context.Background(), "test1", db, NewPeer(db2))
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.Equal(t, 1, stats.Pulled)
+	assert.Equal(t, 3, stats.Pushed)
+	keys, err := db.GetKeysInRange("test1", "first", "last")
+	assert.Nil(t, err)
+	keys2, err := db2.GetKeysInRange("test1", "first", "last")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, keys, keys2)
+
+	// nothing to do the second time
+	stats, err = Sync(context.Background(), "test1", db, NewPeer(db2))
+	assert.Nil(t, err)
+	assert.Equal(t, SyncStats{Requests: 1}, stats)
 }
 
-type toExchange struct {
-	first string
-	last  string
+func TestFingerprint(t *testing.T) {
+	var a, b accumulator
+	a.add(itemHash([]byte("hello0"), []byte("world")))
+	a.add(itemHash([]byte("hello1"), []byte("world")))
+	b.add(itemHash([]byte("hello1"), []byte("world")))
+	b.add(itemHash([]byte("hello0"), []byte("world")))
+	fmt.Println(a.fingerprint())
+	assert.Equal(t, a.fingerprint(), b.fingerprint())
+	assert.Nil(t, checkFingerprint(a.fingerprint()))
+	assert.Equal(t, ErrFingerprintVersion, checkFingerprint("7d4c0f21"))
+	assert.Equal(t, ErrFingerprintVersion, checkFingerprint("2:00"))
+
+	// values count, and so does where the key ends
+	assert.NotEqual(t, itemHash([]byte("hello0"), []byte("world")), itemHash([]byte("hello0"), []byte("world2")))
+	assert.NotEqual(t, itemHash([]byte("ab"), []byte("c")), itemHash([]byte("a"), []byte("bc")))
+
+	// the sum carries across the words
+	var c accumulator
+	var ones [32]byte
+	for i := range ones {
+		ones[i] = 0xff
+	}
+	c.add(ones)
+	c.add([32]byte{1})
+	assert.Equal(t, accumulator{}, c)
 }
 
-func findExchange(bucket, first, last string, db *DB, db2 *DB, exchange1 []toExchange) (finalExchange []toExchange, err error) {
-	exchange2, err := find(bucket, first, last, db, db2, exchange1)
-	if err != nil {
-		return
+func TestDeleteExpired(t *testing.T) {
+	os.Remove("3.db")
+	db, err := New("3.db")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+
+	authorityPublic, authorityPrivate, _ := sign.GenerateKey(crypto_rand.Reader)
+	authority := base58.FastBase58Encoding(authorityPublic[:])
+	bob, _ := keypair.New()
+
+	fresh, _ := mail.New(db.worldKey, bob, []string{bob.Public}, []byte("fresh"),
+		mail.WithExpiry(authtime.Sign(time.Now(), authorityPrivate), time.Hour))
+	stale, _ := mail.New(db.worldKey, bob, []string{bob.Public}, []byte("stale"),
+		mail.WithExpiry(authtime.Sign(time.Now().Add(-2*time.Hour), authorityPrivate), time.Hour))
+	forever, _ := mail.New(db.worldKey, bob, []string{bob.Public}, []byte("forever"))
+	assert.Nil(t, db.Set("mail", "fresh", fresh))
+	assert.Nil(t, db.Set("mail", "stale", stale))
+	assert.Nil(t, db.Set("mail", "forever", forever))
+	assert.Nil(t, db.Set("mail", "other", "not a message"))
+	assert.Nil(t, db.Set("mail", "unchecked", map[string]string{"t": "not a time"}))
+
+	deleted, err := db.DeleteExpired("mail", mail.Expired(authority, time.Now()))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	keys, err := db.GetKeysInRange("mail", "first", "last")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"forever", "fresh", "other", "unchecked"}, keys)
+
+	// the expired message keeps a tombstone, which is not deleted again
+	var msg mail.Message
+	assert.NotNil(t, db.Get("mail", "stale", &msg))
+	deleted, err = db.DeleteExpired("mail", mail.Expired(authority, time.Now()))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestSync(t *testing.T) {
+	os.Remove("4.db")
+	os.Remove("5.db")
+	defer os.Remove("4.db")
+	defer os.Remove("5.db")
+	db, _ := New("4.db", WithNode("a"))
+	defer db.Close()
+	db2, _ := New("5.db", WithNode("b"))
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		switch {
+		case i%17 == 0:
+			assert.Nil(t, db.Set("mail", key, i))
+		case i%23 == 0:
+			assert.Nil(t, db2.Set("mail", key, i))
+		default:
+			assert.Nil(t, db.Set("mail", key, i))
+			assert.Nil(t, db2.Set("mail", key, i))
+		}
 	}
-	finalExchange = make([]toExchange, len(exchange2))
-	num := 0
-	for i, ex := range exchange2 {
-		if i == 0 {
-			finalExchange[num] = ex
-			num++
+
+	// same key, different value
+	assert.Nil(t, db2.Set("mail", "key005", 500))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Sync(ctx, "mail", db, NewPeer(db2))
+	assert.Equal(t, context.Canceled, err)
+
+	stats, err := Sync(context.Background(), "mail", db, NewPeer(db2))
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.Equal(t, 9, stats.Pulled)
+	assert.Equal(t, 12, stats.Pushed)
+	assert.Equal(t, 1, stats.Conflicts)
+	var i int
+	// the later write wins
+	assert.Nil(t, db.Get("mail", "key005", &i))
+	assert.Equal(t, 500, i)
+	assert.Nil(t, db.Get("mail", "key023", &i))
+	assert.Equal(t, 23, i)
+	assert.Nil(t, db2.Get("mail", "key017", &i))
+	assert.Equal(t, 17, i)
+}
+
+func TestHTTPSync(t *testing.T) {
+	os.Remove("6.db")
+	os.Remove("7.db")
+	defer os.Remove("6.db")
+	defer os.Remove("7.db")
+	db, _ := New("6.db")
+	defer db.Close()
+	db2, _ := New("7.db")
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, db.Set("mail", fmt.Sprintf("key%02d", i), i))
+		}
+		if i%3 == 0 {
+			assert.Nil(t, db2.Set("mail", fmt.Sprintf("key%02d", i), i))
+		}
+	}
+
+	srv := httptest.NewServer(NewHandler(db2))
+	defer srv.Close()
+	peer := NewHTTPPeer(srv.URL, nil)
+	stats, err := Sync(context.Background(), "mail", db, peer)
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	keys, _ := db.GetKeysInRange("mail", "first", "last")
+	keys2, _ := db2.GetKeysInRange("mail", "first", "last")
+	assert.Equal(t, 33, len(keys))
+	assert.Equal(t, keys, keys2)
+
+	_, err = peer.Keys(context.Background(), "nope", "first", "last")
+	assert.NotNil(t, err)
+
+	// bodies are only read up to the limit
+	resp, err := http.Post(srv.URL+"/sketch?bucket=mail", "application/octet-stream", bytes.NewReader(make([]byte, MaxRequestSize+1)))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// scanRangeOfHashes is getRangeOfHashes with a walk over the bucket.
+func scanRangeOfHashes(db *DB, bucket, first, last string) (rangeHash string, middleKey string, count int) {
+	var acc accumulator
+	var keys []string
+	db.db.View(func(tx *bolt.Tx) error {
+		eachInRange(tx.Bucket([]byte(bucket)).Cursor(), first, last, func(k, v []byte) bool {
+			acc.add(itemHash(k, content(v)))
+			keys = append(keys, string(k))
+			return true
+		})
+		return nil
+	})
+	if len(keys) > 0 {
+		middleKey = keys[len(keys)/2]
+	}
+	return acc.fingerprint(), middleKey, len(keys)
+}
+
+func TestTree(t *testing.T) {
+	os.Remove("8.db")
+	defer os.Remove("8.db")
+	db, _ := New("8.db")
+	defer db.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db.Set("mail", "key000", 0))
+	// builds the tree, which is then kept up to date
+	_, _, count, err := db.getRangeOfHashes("mail", "first", "last")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	r := rand.New(rand.NewSource(1))
+	key := func() string { return fmt.Sprintf("key%03d", r.Intn(300)) }
+	for i := 0; i < 2000; i++ {
+		switch r.Intn(4) {
+		case 0:
+			assert.Nil(t, db.Delete("mail", key()))
+		case 1:
+			assert.Nil(t, db.setValues("mail", map[string][]byte{key(): []byte("1"), key(): []byte("2")}))
+		default:
+			assert.Nil(t, db.Set("mail", key(), i))
+		}
+		if i%100 != 0 {
 			continue
 		}
-		if finalExchange[num-1].last == ex.first {
-			finalExchange[num-1].last = ex.last
+		for _, bounds := range [][2]string{{"first", "last"}, {"first", key()}, {key(), "last"}, {key(), key()}, {"key100", "key101"}} {
+			rangeHash, middleKey, count, err := db.getRangeOfHashes("mail", bounds[0], bounds[1])
+			assert.Nil(t, err)
+			scanHash, scanMiddle, scanCount := scanRangeOfHashes(db, "mail", bounds[0], bounds[1])
+			assert.Equal(t, scanHash, rangeHash, bounds)
+			assert.Equal(t, scanMiddle, middleKey, bounds)
+			assert.Equal(t, scanCount, count, bounds)
+		}
+	}
+
+	_, _, _, err = db.getRangeOfHashes("nope", "first", "last")
+	assert.NotNil(t, err)
+}
+
+func BenchmarkRangeOfHashes(b *testing.B) {
+	os.Remove("9.db")
+	defer os.Remove("9.db")
+	db, _ := New("9.db")
+	defer db.Close()
+	db.NewBucket("mail")
+	values := make(map[string][]byte)
+	for i := 0; i < 100000; i++ {
+		values[fmt.Sprintf("key%06d", i)] = []byte("world")
+	}
+	db.setValues("mail", values)
+	db.getRangeOfHashes("mail", "first", "last")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.getRangeOfHashes("mail", "key012345", "key054321")
+	}
+}
+
+// TestNegentropyMessages checks the messages against the protocol of
+// https://github.com/hoytech/negentropy.
+func TestNegentropyMessages(t *testing.T) {
+	// an empty set sends an empty ID list up to infinity
+	n, _ := newNegentropy(nil, 0)
+	assert.Equal(t, "6100000200", hex.EncodeToString(n.initiate()))
+
+	a, b := [32]byte{}, [32]byte{}
+	a[0], b[0] = 0xaa, 0xbb
+	n, _ = newNegentropy([]Item{{Timestamp: 5, ID: a}}, 0)
+	assert.Equal(t, "6100000201"+hex.EncodeToString(a[:]), hex.EncodeToString(n.initiate()))
+	// the responder answers with its own IDs in the range
+	m, _ := newNegentropy([]Item{{Timestamp: 5, ID: b}}, 0)
+	response, _, _, err := m.reconcile(n.initiate())
+	assert.Nil(t, err)
+	assert.Equal(t, "6100000201"+hex.EncodeToString(b[:]), hex.EncodeToString(response))
+	out, have, need, err := n.reconcile(response)
+	assert.Nil(t, err)
+	assert.Nil(t, out)
+	assert.Equal(t, [][32]byte{a}, have)
+	assert.Equal(t, [][32]byte{b}, need)
+
+	// other versions are answered with the version that is spoken
+	response, _, _, err = m.reconcile([]byte{0x62})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x61}, response)
+
+	// 32 items are split into 16 ranges of 2. The bounds are the
+	// differences of the timestamps plus one, without an ID prefix, and
+	// the fingerprint is the SHA-256 of the sum of the IDs and the count.
+	var items []Item
+	for i := 0; i < 32; i++ {
+		var id [32]byte
+		for j := range id {
+			id[j] = byte(i)
+		}
+		items = append(items, Item{Timestamp: uint64(i), ID: id})
+	}
+	n, _ = newNegentropy(items, 0)
+	want := []byte{0x61}
+	for i := 0; i < 32; i += 2 {
+		if i == 30 {
+			want = append(want, 0x00, 0x00, 0x01)
 		} else {
-			finalExchange[num] = ex
-			num++
+			want = append(want, 0x03, 0x00, 0x01)
 		}
+		var sum [33]byte
+		for j := 0; j < 32; j++ {
+			sum[j] = byte(2*i + 1)
+		}
+		sum[32] = 2
+		fp := sha256.Sum256(sum[:])
+		want = append(want, fp[:16]...)
 	}
-	finalExchange = finalExchange[:num]
-	return
+	assert.Equal(t, hex.EncodeToString(want), hex.EncodeToString(n.initiate()))
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1 << 63} {
+		b := encodeVarint(v)
+		got, rest, err := decodeVarint(append(b, 0xff))
+		assert.Nil(t, err)
+		assert.Equal(t, v, got)
+		assert.Equal(t, []byte{0xff}, rest)
+	}
+	assert.Equal(t, []byte{0x81, 0x00}, encodeVarint(128))
+	_, _, err := decodeVarint([]byte{0x81})
+	assert.Equal(t, ErrNegentropy, err)
+}
+
+func TestNegentropy(t *testing.T) {
+	os.Remove("10.db")
+	os.Remove("11.db")
+	defer os.Remove("10.db")
+	defer os.Remove("11.db")
+	db, _ := New("10.db")
+	defer db.Close()
+	db2, _ := New("11.db")
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+
+	r := rand.New(rand.NewSource(1))
+	values, values2 := map[string][]byte{}, map[string][]byte{}
+	onlyLocal, onlyRemote := 0, 0
+	for i := 0; i < 5000; i++ {
+		var id [32]byte
+		r.Read(id[:])
+		key := TimestampKey(uint64(1600000000+r.Intn(1000)), id)
+		switch r.Intn(20) {
+		case 0:
+			values[key] = []byte("1")
+			onlyLocal++
+		case 1:
+			values2[key] = []byte("2")
+			onlyRemote++
+		default:
+			values[key] = []byte("3")
+			values2[key] = []byte("3")
+		}
+	}
+	// other keys are items too
+	values["hello"] = []byte("4")
+	onlyLocal++
+	assert.Nil(t, db.setValues("mail", values))
+	assert.Nil(t, db2.setValues("mail", values2))
+
+	item := keyItem(TimestampKey(42, [32]byte{1, 2, 3}))
+	assert.Equal(t, uint64(42), item.Timestamp)
+	assert.Equal(t, byte(3), item.ID[2])
+
+	_, err := SyncNegentropy(context.Background(), "mail", db, NewPeer(db2).(NegentropyPeer), 1000)
+	assert.NotNil(t, err)
+
+	srv := httptest.NewServer(NewHandler(db2))
+	defer srv.Close()
+	stats, err := SyncNegentropy(context.Background(), "mail", db, NewHTTPPeer(srv.URL, nil), 4096)
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.Equal(t, onlyRemote, stats.Pulled)
+	assert.Equal(t, onlyLocal, stats.Pushed)
+	keys, _ := db.GetKeysInRange("mail", "first", "last")
+	keys2, _ := db2.GetKeysInRange("mail", "first", "last")
+	assert.Equal(t, keys, keys2)
+
+	// changed values and deletions are found by comparing the values
+	assert.Nil(t, db.Set("mail", "hello", "6"))
+	assert.Nil(t, db2.Delete("mail", keys[0]))
+	stats, err = SyncNegentropy(context.Background(), "mail", db, NewHTTPPeer(srv.URL, nil), 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Pulled)
+	assert.Equal(t, 1, stats.Pushed)
+	var s string
+	assert.Nil(t, db2.Get("mail", "hello", &s))
+	assert.Equal(t, "6", s)
+	assert.NotNil(t, db.Get("mail", keys[0], &s))
+
+	// without a frame size limit the ranges are split twice, then the
+	// value is fetched and the values are compared once
+	assert.Nil(t, db2.Set("mail", "hello2", "5"))
+	stats, err = SyncNegentropy(context.Background(), "mail", db, NewPeer(db2).(NegentropyPeer), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, SyncStats{Requests: 4, Pulled: 1}, stats)
+}
+
+// smallSketchPeer answers with a table that is too small to be decoded.
+type smallSketchPeer struct {
+	SketchPeer
+	db *DB
+}
+
+func (p smallSketchPeer) Sketch(ctx context.Context, bucket string, estimator []byte) ([]byte, error) {
+	hashes, err := p.db.itemHashes(bucket)
+	t := newIBLT(3)
+	for h := range hashes {
+		t.add(h, 1)
+	}
+	return t.encode(), err
 }
 
-func find(bucket, first, last string, db *DB, db2 *DB, exchange1 []toExchange) (exchange2 []toExchange, err error) {
-	exchange2 = exchange1
-	rangeHash, middleKey, count, err := db.getRangeOfHashes(bucket, first, last)
-	if err != nil {
-		return
+func TestSketch(t *testing.T) {
+	os.Remove("12.db")
+	os.Remove("13.db")
+	defer os.Remove("12.db")
+	defer os.Remove("13.db")
+	db, _ := New("12.db")
+	defer db.Close()
+	db2, _ := New("13.db")
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+
+	r := rand.New(rand.NewSource(2))
+	values, values2 := map[string][]byte{}, map[string][]byte{}
+	onlyLocal, onlyRemote := 0, 0
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", r.Int63())
+		switch r.Intn(10) {
+		case 0:
+			values[key] = []byte("1")
+			onlyLocal++
+		case 1:
+			values2[key] = []byte("2")
+			onlyRemote++
+		default:
+			values[key] = []byte("3")
+			values2[key] = []byte("3")
+		}
 	}
-	log.Println("checking", rangeHash)
-	isEqual, err := db2.checkRangeOfHashes(bucket, first, last, rangeHash)
-	if err != nil {
-		return
+	values["both"] = []byte("4")
+	values2["both"] = []byte("5")
+	assert.Nil(t, db.setValues("mail", values))
+	assert.Nil(t, db2.setValues("mail", values2))
+
+	e, e2 := newEstimator(), newEstimator()
+	hashes, _ := db.itemHashes("mail")
+	for h := range hashes {
+		e.add(h)
 	}
-	if isEqual {
-		return
+	hashes2, _ := db2.itemHashes("mail")
+	for h := range hashes2 {
+		e2.add(h)
 	}
+	decoded, err := decodeEstimator(e.encode())
+	assert.Nil(t, err)
+	estimate := decoded.estimate(e2)
+	fmt.Println(estimate, onlyLocal+onlyRemote+2)
+	assert.True(t, estimate > (onlyLocal+onlyRemote)/2)
+	assert.True(t, estimate < 2*(onlyLocal+onlyRemote))
+
+	srv := httptest.NewServer(NewHandler(db2))
+	defer srv.Close()
+	stats, err := SyncSketch(context.Background(), "mail", db, NewHTTPPeer(srv.URL, nil))
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	// the conflict is merged to the larger value, since neither has a
+	// version
+	assert.Equal(t, SyncStats{Requests: 3, Pulled: onlyRemote + 1, Pushed: onlyLocal, Conflicts: 1}, stats)
+	var both int
+	assert.Nil(t, db.Get("mail", "both", &both))
+	assert.Equal(t, 5, both)
+	keys, _ := db.GetKeysInRange("mail", "first", "last")
+	keys2, _ := db2.GetKeysInRange("mail", "first", "last")
+	assert.Equal(t, keys, keys2)
 
-	// not equal, search some more
-	if count == 1 {
-		log.Println("exchange", first, last)
-		exchange2 = append(exchange2, toExchange{first, last})
-		return
+	// a table that is too small falls back to bisection
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set("mail", fmt.Sprintf("new%d", i), i))
 	}
+	stats, err = SyncSketch(context.Background(), "mail", db, smallSketchPeer{NewPeer(db2).(SketchPeer), db2})
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.True(t, stats.Fallback)
+	assert.Equal(t, 10, stats.Pushed)
+
+	stats, err = SyncSketch(context.Background(), "mail", db, NewPeer(db2).(SketchPeer))
+	assert.Nil(t, err)
+	assert.Equal(t, SyncStats{Requests: 1}, stats)
 
-	exchange2, err = find(bucket, first, middleKey, db, db2, exchange2)
-	if err != nil {
-		return
+	// an estimator that can not be decoded does not make a huge table
+	bad := newEstimator()
+	for i := 0; i < 1000; i++ {
+		var id [32]byte
+		r.Read(id[:])
+		bad[strata-1].add(id, 1)
 	}
-	exchange2, err = find(bucket, middleKey, last, db, db2, exchange2)
-	if err != nil {
-		return
+	_, err = db2.sketch("mail", bad.encode())
+	assert.Equal(t, ErrDecode, err)
+	_, err = NewHTTPPeer(srv.URL, nil).Sketch(context.Background(), "mail", bad.encode())
+	assert.Equal(t, ErrDecode, err)
+}
+
+func TestTombstone(t *testing.T) {
+	os.Remove("14.db")
+	os.Remove("15.db")
+	defer os.Remove("14.db")
+	defer os.Remove("15.db")
+	db, _ := New("14.db")
+	defer db.Close()
+	db2, _ := New("15.db")
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set("mail", fmt.Sprintf("key%03d", i), i))
 	}
+	_, err := Sync(context.Background(), "mail", db2, NewPeer(db))
+	assert.Nil(t, err)
+
+	// a deleted key is gone but keeps a tombstone
+	assert.Nil(t, db.Delete("mail", "key010"))
+	var v int
+	assert.NotNil(t, db.Get("mail", "key010", &v))
+	keys, _ := db.GetKeysInRange("mail", "first", "last")
+	assert.Equal(t, 99, len(keys))
+	keys, _ = db.keysInRange("mail", "first", "last", true)
+	assert.Equal(t, 100, len(keys))
+
+	// the delete is copied instead of the key coming back
+	stats, err := Sync(context.Background(), "mail", db2, NewPeer(db))
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.Equal(t, 1, stats.Pulled)
+	assert.NotNil(t, db2.Get("mail", "key010", &v))
+	stats, err = Sync(context.Background(), "mail", db, NewPeer(db2))
+	assert.Nil(t, err)
+	assert.Equal(t, SyncStats{Requests: 1}, stats)
+
+	// and pushed by the sketch sync
+	assert.Nil(t, db2.Delete("mail", "key020"))
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+	stats, err = SyncSketch(context.Background(), "mail", db2, NewHTTPPeer(srv.URL, nil))
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.Equal(t, 1, stats.Pushed)
+	assert.NotNil(t, db.Get("mail", "key020", &v))
+
+	// tombstones are kept until the horizon
+	deleted, err := db.DeleteTombstones("mail", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deleted)
+	deleted, err = db.DeleteTombstones("mail", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+	keys, _ = db.keysInRange("mail", "first", "last", true)
+	assert.Equal(t, 98, len(keys))
+	assert.Equal(t, db.trees["mail"].root.size, 98)
+}
+
+func TestVersion(t *testing.T) {
+	os.Remove("16.db")
+	os.Remove("17.db")
+	defer os.Remove("16.db")
+	defer os.Remove("17.db")
+	db, _ := New("16.db", WithNode("a"))
+	defer db.Close()
+	db2, _ := New("17.db", WithNode("b"))
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+	_, err := New("18.db", WithNode(strings.Repeat("n", 256)))
+	assert.Equal(t, ErrNodeName, err)
+
+	// values stored before versions are read with the zero version
+	assert.Nil(t, db.setValues("mail", map[string][]byte{"old": []byte(`"old"`)}))
+	var v string
+	assert.Nil(t, db.Get("mail", "old", &v))
+	assert.Equal(t, "old", v)
+	values, _ := db.getValues("mail", []string{"old"})
+	assert.Equal(t, Version{}, decodeVersioned(values["old"]).Version)
+
+	assert.Nil(t, db.Set("mail", "key", "first"))
+	values, _ = db.getValues("mail", []string{"key"})
+	first := decodeVersioned(values["key"])
+	assert.Equal(t, "a", first.Node)
+	assert.Equal(t, `"first"`, string(first.Value))
+	assert.True(t, time.Since(first.Clock.Time()) < time.Minute)
+
+	// the later write wins on both sides
+	_, err = Sync(context.Background(), "mail", db2, NewPeer(db))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set("mail", "key", "second"))
+	assert.Nil(t, db2.Set("mail", "key", "third"))
+	assert.Nil(t, db2.Delete("mail", "old"))
+	stats, err := Sync(context.Background(), "mail", db, NewPeer(db2))
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.Equal(t, 2, stats.Conflicts)
+	assert.Equal(t, 2, stats.Pulled)
+	assert.Equal(t, 0, stats.Pushed)
+	assert.Nil(t, db.Get("mail", "key", &v))
+	assert.Equal(t, "third", v)
+	assert.NotNil(t, db.Get("mail", "old", &v))
+
+	// a clock from the far future is not stored, nor does it move the clock
+	future := encodeVersioned(Versioned{Version: Version{^HLC(0), "b"}, Value: []byte(`"future"`)})
+	assert.Nil(t, db.setValues("mail", map[string][]byte{"key": future}))
+	assert.Nil(t, db.Get("mail", "key", &v))
+	assert.Equal(t, "third", v)
+	assert.True(t, db.clock.now() < physical(time.Now().Add(time.Minute)))
+
+	// a write after the delete brings the key back
+	assert.Nil(t, db.Set("mail", "old", "new"))
+	stats, err = Sync(context.Background(), "mail", db, NewPeer(db2))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Pushed)
+	assert.Nil(t, db2.Get("mail", "old", &v))
+	assert.Equal(t, "new", v)
+
+	// a merge can make a new value, which wins on both sides
+	union := func(key string, local, remote Versioned) Versioned {
+		var a, b []string
+		json.Unmarshal(local.Value, &a)
+		json.Unmarshal(remote.Value, &b)
+		set := map[string]bool{}
+		for _, s := range append(a, b...) {
+			set[s] = true
+		}
+		a = a[:0]
+		for s := range set {
+			a = append(a, s)
+		}
+		sort.Strings(a)
+		value, _ := json.Marshal(a)
+		return Versioned{Value: value}
+	}
+	db.SetMerge("mail", union)
+	db2.SetMerge("mail", union)
+	assert.Nil(t, db.Set("mail", "list", []string{"x"}))
+	assert.Nil(t, db2.Set("mail", "list", []string{"y"}))
+	stats, err = Sync(context.Background(), "mail", db, NewPeer(db2))
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.Equal(t, 1, stats.Conflicts)
+	assert.Equal(t, 1, stats.Pushed)
+	var list []string
+	assert.Nil(t, db.Get("mail", "list", &list))
+	assert.Equal(t, []string{"x", "y"}, list)
+	assert.Nil(t, db2.Get("mail", "list", &list))
+	assert.Equal(t, []string{"x", "y"}, list)
+	stats, err = Sync(context.Background(), "mail", db, NewPeer(db2))
+	assert.Nil(t, err)
+	assert.Equal(t, SyncStats{Requests: 1}, stats)
+}
 
+// aheadPeer answers with fixed changes.
+type aheadPeer struct {
+	LogPeer
+	changes []Change
+}
+
+func (p aheadPeer) Changes(ctx context.Context, bucket string, since uint64, limit int) (changes []Change, err error) {
+	for _, c := range p.changes {
+		if c.Seq > since {
+			changes = append(changes, c)
+		}
+	}
+	return
+}
+
+func TestOplog(t *testing.T) {
+	os.Remove("19.db")
+	os.Remove("20.db")
+	defer os.Remove("19.db")
+	defer os.Remove("20.db")
+	db, _ := New("19.db")
+	defer db.Close()
+	db2, _ := New("20.db")
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set("mail", fmt.Sprintf("key%d", i), i))
+	}
+	assert.Nil(t, db.Delete("mail", "key3"))
+	seq, err := db.Seq("mail")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(11), seq)
+	changes, err := db.Changes("mail", 8, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, uint64(9), changes[0].Seq)
+	assert.Equal(t, "key8", changes[0].Key)
+	assert.Equal(t, "key3", changes[2].Key)
+	assert.True(t, changes[2].Versioned().Deleted)
+	changes, _ = db.Changes("mail", 0, 4)
+	assert.Equal(t, 4, len(changes))
+
+	// a follower catches up with the changes
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+	remote := NewHTTPPeer(srv.URL, nil)
+	stats, seq, err := SyncChanges(context.Background(), "mail", db2, remote, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, SyncStats{Requests: 1, Pulled: 10}, stats)
+	assert.Equal(t, uint64(11), seq)
+	keys, _ := db.GetKeysInRange("mail", "first", "last")
+	keys2, _ := db2.GetKeysInRange("mail", "first", "last")
+	assert.Equal(t, keys, keys2)
+
+	assert.Nil(t, db.Set("mail", "key10", 10))
+	stats, seq, err = SyncChanges(context.Background(), "mail", db2, remote, seq)
+	assert.Nil(t, err)
+	assert.Equal(t, SyncStats{Requests: 1, Pulled: 1}, stats)
+	assert.Equal(t, uint64(12), seq)
+
+	// the changes that were pulled are in the log of the follower too
+	seq2, _ := db2.Seq("mail")
+	assert.Equal(t, uint64(11), seq2)
+
+	// after the log is truncated the follower has to Sync
+	assert.Nil(t, db.Set("mail", "key11", 11))
+	assert.Nil(t, db.Set("mail", "key12", 12))
+	deleted, err := db.TruncateLog("mail", 14)
+	assert.Nil(t, err)
+	assert.Equal(t, 13, deleted)
+	_, err = db.Changes("mail", 12, 0)
+	assert.Equal(t, ErrTruncated, err)
+	stats, seq, err = SyncChanges(context.Background(), "mail", db2, remote, 12)
+	assert.Nil(t, err)
+	fmt.Printf("%+v\n", stats)
+	assert.True(t, stats.Fallback)
+	assert.Equal(t, 2, stats.Pulled)
+	assert.Equal(t, uint64(14), seq)
+	changes, err = db.Changes("mail", seq, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changes))
+
+	// a bucket from before the log starts truncated
+	assert.Nil(t, db.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(logName("mail"))
+	}))
+	_, err = db.Changes("mail", 0, 0)
+	assert.Equal(t, ErrTruncated, err)
+	assert.Nil(t, db.Set("mail", "key13", 13))
+	_, err = db.Changes("mail", 0, 0)
+	assert.Equal(t, ErrTruncated, err)
+	changes, err = db.Changes("mail", 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changes))
+
+	// changes from a clock too far ahead are pulled again
+	ahead := aheadPeer{LogPeer: NewPeer(db).(LogPeer), changes: []Change{
+		{Seq: 20, Key: "a", Value: encodeVersioned(Versioned{Version: Version{db.clock.now(), "a"}, Value: []byte("1")})},
+		{Seq: 21, Key: "b", Value: encodeVersioned(Versioned{Version: Version{^HLC(0), "a"}, Value: []byte("2")})},
+		{Seq: 22, Key: "c", Value: encodeVersioned(Versioned{Version: Version{db.clock.now(), "a"}, Value: []byte("3")})},
+	}}
+	for i := 0; i < 2; i++ {
+		stats, seq, err = SyncChanges(context.Background(), "mail", db2, ahead, 19)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, stats.Pulled)
+		assert.Equal(t, uint64(20), seq)
+	}
+
+	// the log only keeps the last changes
+	os.Remove("23.db")
+	defer os.Remove("23.db")
+	db3, _ := New("23.db", WithLogSize(5))
+	defer db3.Close()
+	assert.Nil(t, db3.NewBucket("mail"))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db3.Set("mail", fmt.Sprintf("key%d", i), i))
+	}
+	_, err = db3.Changes("mail", 4, 0)
+	assert.Equal(t, ErrTruncated, err)
+	changes, err = db3.Changes("mail", 5, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(changes))
+}
+
+// nextEvent returns the next event, or fails after a second.
+func nextEvent(t *testing.T, events <-chan Event) (e Event) {
+	select {
+	case e = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
 	return
 }
 
-func TestAdler(t *testing.T) {
-	adlerHash := adler32.New()
-	adlerHash.Write([]byte("hello, world"))
-	adlerHash.Write([]byte("hello, world2"))
+func TestWatch(t *testing.T) {
+	os.Remove("21.db")
+	os.Remove("22.db")
+	defer os.Remove("21.db")
+	defer os.Remove("22.db")
+	db, _ := New("21.db")
+	defer db.Close()
+	db2, _ := New("22.db")
+	defer db2.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+	assert.Nil(t, db2.NewBucket("mail"))
+	assert.Nil(t, db.Set("mail", "a/0", 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := db.Watch(ctx, "mail", "a/")
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set("mail", "a/1", 1))
+	assert.Nil(t, db.Set("mail", "b/1", 1))
+	assert.Nil(t, db.Delete("mail", "a/1"))
+	e := nextEvent(t, events)
+	fmt.Printf("%+v\n", e)
+	assert.Equal(t, EventSet, e.Type)
+	assert.Equal(t, "a/1", e.Key)
+	assert.Equal(t, uint64(2), e.Seq)
+	var i int
+	assert.Nil(t, e.Decode(&i))
+	assert.Equal(t, 1, i)
+	e = nextEvent(t, events)
+	assert.Equal(t, EventDelete, e.Type)
+	assert.Equal(t, uint64(4), e.Seq)
+
+	// values that sync stores are events too
+	assert.Nil(t, db2.Set("mail", "a/2", 2))
+	_, err = Sync(context.Background(), "mail", db, NewPeer(db2))
+	assert.Nil(t, err)
+	e = nextEvent(t, events)
+	assert.Equal(t, "a/2", e.Key)
+	assert.Equal(t, db2.node, e.Version.Node)
+	last := e.Seq
 
-	a := make([]byte, 4)
-	binary.LittleEndian.PutUint32(a, adlerHash.Sum32())
-	fmt.Println(base64.StdEncoding.EncodeToString(a))
+	// a consumer that does not keep up does not hold up the writes, and
+	// one that restarts goes on where it stopped
+	cancel()
+	for range events {
+	}
+	for i := 0; i < 250; i++ {
+		assert.Nil(t, db.Set("mail", fmt.Sprintf("a/%03d", i), i))
+	}
+	events, err = db.Watch(context.Background(), "mail", "a/", WithSince(last))
+	assert.Nil(t, err)
+	for i := 0; i < 250; i++ {
+		e = nextEvent(t, events)
+		assert.Equal(t, fmt.Sprintf("a/%03d", i), e.Key)
+	}
+
+	_, err = db.TruncateLog("mail", 10)
+	assert.Nil(t, err)
+	_, err = db.Watch(context.Background(), "mail", "a/", WithSince(0))
+	assert.Equal(t, ErrTruncated, err)
 }
@@ -0,0 +1,49 @@
+package depot
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeleteExpired deletes every value in the bucket that has expired, which
+// is told by the JSON of the value, such as with mail.Expired.
+func (db *DB) DeleteExpired(bucket string, isExpired func(value []byte) bool) (deleted int, err error) {
+	db.Lock()
+	defer db.Unlock()
+	tombstone := db.tombstone()
+	var expired [][]byte
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		expired = nil
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			versioned := decodeVersioned(v)
+			if !versioned.Deleted && isExpired(versioned.Value) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+		}
+		for _, k := range expired {
+			if _, err := db.appendLog(tx, bucket, k, tombstone); err != nil {
+				return err
+			}
+			if err := b.Put(k, tombstone); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	if err == nil {
+		for _, k := range expired {
+			db.treeSet(bucket, string(k), tombstone)
+		}
+		if len(expired) > 0 {
+			db.wake(bucket)
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package depot
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// FingerprintVersion is the version of the range fingerprints. Peers with
+// a different version can not be synced with.
+const FingerprintVersion = 1
+
+// ErrFingerprintVersion is returned when a peer uses another fingerprint.
+var ErrFingerprintVersion = errors.New("depot: peer uses another fingerprint version")
+
+// accumulator is the sum of item hashes modulo 2^256, as a little endian
+// number. The sum does not depend on the order that items are added in,
+// and items can be taken out again.
+type accumulator [32]byte
+
+// itemHash is the SHA-256 of the length of the key, the key and the value,
+// which is the content of a stored value.
+func itemHash(key, value []byte) (h [32]byte) {
+	s := sha256.New()
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(key)))
+	s.Write(n[:])
+	s.Write(key)
+	s.Write(value)
+	copy(h[:], s.Sum(nil))
+	return
+}
+
+func (a *accumulator) add(h [32]byte) {
+	var carry uint64
+	for i := 0; i < 32; i += 8 {
+		x := binary.LittleEndian.Uint64(a[i:])
+		y := binary.LittleEndian.Uint64(h[i:])
+		var sum uint64
+		sum, carry = bits.Add64(x, y, carry)
+		binary.LittleEndian.PutUint64(a[i:], sum)
+	}
+}
+
+func (a *accumulator) sub(h [32]byte) {
+	var borrow uint64
+	for i := 0; i < 32; i += 8 {
+		x := binary.LittleEndian.Uint64(a[i:])
+		y := binary.LittleEndian.Uint64(h[i:])
+		var diff uint64
+		diff, borrow = bits.Sub64(x, y, borrow)
+		binary.LittleEndian.PutUint64(a[i:], diff)
+	}
+}
+
+// fingerprint returns the versioned fingerprint, "version:hex".
+func (a accumulator) fingerprint() string {
+	return fmt.Sprintf("%d:%x", FingerprintVersion, a[:])
+}
+
+// checkFingerprint makes sure that a fingerprint has our version.
+func checkFingerprint(fingerprint string) (err error) {
+	i := strings.IndexByte(fingerprint, ':')
+	if i < 0 {
+		return ErrFingerprintVersion
+	}
+	version, err := strconv.Atoi(fingerprint[:i])
+	if err != nil || version != FingerprintVersion {
+		return ErrFingerprintVersion
+	}
+	if _, err = hex.DecodeString(fingerprint[i+1:]); err != nil {
+		return ErrFingerprintVersion
+	}
+	return nil
+}
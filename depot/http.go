@@ -0,0 +1,324 @@
+package depot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// rangeResponse is the answer to a range request.
+type rangeResponse struct {
+	Hash   string `json:"hash"`
+	Middle string `json:"middle"`
+	Count  int    `json:"count"`
+}
+
+// valuesRequest asks for or stores values.
+type valuesRequest struct {
+	Bucket string            `json:"bucket"`
+	Keys   []string          `json:"keys,omitempty"`
+	Values map[string][]byte `json:"values,omitempty"`
+	IDs    [][]byte          `json:"ids,omitempty"`
+	Hashes [][]byte          `json:"hashes,omitempty"`
+}
+
+// MaxRequestSize is the largest request body that NewHandler reads.
+const MaxRequestSize = 32 << 20
+
+// maxResponseSize is the largest response body that an httpPeer reads.
+const maxResponseSize = 256 << 20
+
+// NewHandler returns the HTTP handlers that let a remote node Sync with
+// the DB. Anyone that can reach them can store any value, so they should
+// only be served to trusted peers:
+//
+//	GET  /range?bucket=&first=&last=  range fingerprint, middle key and count
+//	GET  /keys?bucket=&first=&last=   keys in the range
+//	POST /values                       values of the keys
+//	POST /set                          store values
+//	POST /negentropy?bucket=           answer a negentropy message
+//	POST /ids                          keys and values of negentropy IDs
+//	POST /sketch?bucket=               answer a strata estimator with an IBLT, 422 if too large
+//	POST /hashes                       keys and values of item hashes
+//	GET  /changes?bucket=&since=&limit= changes in the log, 410 if truncated
+//	GET  /seq?bucket=                  sequence number of the last change
+func NewHandler(db *DB) http.Handler {
+	peer := NewPeer(db)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var resp rangeResponse
+		var err error
+		resp.Hash, resp.Middle, resp.Count, err = peer.RangeHash(r.Context(), q.Get("bucket"), q.Get("first"), q.Get("last"))
+		writeJSON(w, resp, err)
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		keys, err := peer.Keys(r.Context(), q.Get("bucket"), q.Get("first"), q.Get("last"))
+		writeJSON(w, keys, err)
+	})
+	mux.HandleFunc("/values", func(w http.ResponseWriter, r *http.Request) {
+		var req valuesRequest
+		if err := readRequest(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values, err := peer.Values(r.Context(), req.Bucket, req.Keys)
+		writeJSON(w, values, err)
+	})
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		var req valuesRequest
+		if err := readRequest(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := peer.SetValues(r.Context(), req.Bucket, req.Values)
+		writeJSON(w, true, err)
+	})
+	mux.HandleFunc("/negentropy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method is not allowed", http.StatusBadRequest)
+			return
+		}
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := db.respondNegentropy(r.URL.Query().Get("bucket"), query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(response)
+	})
+	mux.HandleFunc("/sketch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method is not allowed", http.StatusBadRequest)
+			return
+		}
+		estimator, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sketch, err := db.sketch(r.URL.Query().Get("bucket"), estimator)
+		if err == ErrDecode {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(sketch)
+	})
+	mux.HandleFunc("/hashes", func(w http.ResponseWriter, r *http.Request) {
+		var req valuesRequest
+		if err := readRequest(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hashes := make([][32]byte, len(req.Hashes))
+		for i, h := range req.Hashes {
+			copy(hashes[i][:], h)
+		}
+		values, err := db.valuesOfHashes(req.Bucket, hashes)
+		writeJSON(w, values, err)
+	})
+	mux.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		since, err := strconv.ParseUint(q.Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		changes, err := db.Changes(q.Get("bucket"), since, limit)
+		writeJSON(w, changes, err)
+	})
+	mux.HandleFunc("/seq", func(w http.ResponseWriter, r *http.Request) {
+		seq, err := db.Seq(r.URL.Query().Get("bucket"))
+		writeJSON(w, seq, err)
+	})
+	mux.HandleFunc("/ids", func(w http.ResponseWriter, r *http.Request) {
+		var req valuesRequest
+		if err := readRequest(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids := make([][idSize]byte, len(req.IDs))
+		for i, id := range req.IDs {
+			copy(ids[i][:], id)
+		}
+		values, err := db.valuesOfIDs(req.Bucket, ids)
+		writeJSON(w, values, err)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxRequestSize)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func readRequest(r *http.Request, v interface{}) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method %s is not allowed", r.Method)
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	if err == ErrTruncated {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// HTTPPeer is a Peer on another node that can take part in every kind of
+// sync.
+type HTTPPeer interface {
+	NegentropyPeer
+	SketchPeer
+	LogPeer
+}
+
+// httpPeer is a Peer on another node, served by NewHandler.
+type httpPeer struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPPeer returns a Peer for the handlers of NewHandler at the URL. A
+// nil client uses http.DefaultClient.
+func NewHTTPPeer(url string, client *http.Client) HTTPPeer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return httpPeer{url: strings.TrimSuffix(url, "/"), client: client}
+}
+
+func (p httpPeer) do(ctx context.Context, method, path string, body interface{}, v interface{}) (err error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err = json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return
+		}
+	}
+	req, err := http.NewRequest(method, p.url+path, &reqBody)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return ErrTruncated
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
+
+func rangeQuery(bucket, first, last string) string {
+	return url.Values{"bucket": {bucket}, "first": {first}, "last": {last}}.Encode()
+}
+
+func (p httpPeer) RangeHash(ctx context.Context, bucket, first, last string) (rangeHash string, middleKey string, count int, err error) {
+	var resp rangeResponse
+	err = p.do(ctx, http.MethodGet, "/range?"+rangeQuery(bucket, first, last), nil, &resp)
+	return resp.Hash, resp.Middle, resp.Count, err
+}
+
+func (p httpPeer) Keys(ctx context.Context, bucket, first, last string) (keys []string, err error) {
+	err = p.do(ctx, http.MethodGet, "/keys?"+rangeQuery(bucket, first, last), nil, &keys)
+	return
+}
+
+func (p httpPeer) Values(ctx context.Context, bucket string, keys []string) (values map[string][]byte, err error) {
+	err = p.do(ctx, http.MethodPost, "/values", valuesRequest{Bucket: bucket, Keys: keys}, &values)
+	return
+}
+
+func (p httpPeer) SetValues(ctx context.Context, bucket string, values map[string][]byte) error {
+	var ok bool
+	return p.do(ctx, http.MethodPost, "/set", valuesRequest{Bucket: bucket, Values: values}, &ok)
+}
+
+// post sends bytes about a bucket and returns the bytes of the answer.
+func (p httpPeer) post(ctx context.Context, path, bucket string, body []byte) (response []byte, err error) {
+	req, err := http.NewRequest(http.MethodPost, p.url+path+"?"+url.Values{"bucket": {bucket}}.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	response, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err == nil && resp.StatusCode == http.StatusUnprocessableEntity {
+		err = ErrDecode
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("POST %s: %s: %s", path, resp.Status, strings.TrimSpace(string(response)))
+	}
+	return
+}
+
+func (p httpPeer) Negentropy(ctx context.Context, bucket string, query []byte) ([]byte, error) {
+	return p.post(ctx, "/negentropy", bucket, query)
+}
+
+func (p httpPeer) Sketch(ctx context.Context, bucket string, estimator []byte) ([]byte, error) {
+	return p.post(ctx, "/sketch", bucket, estimator)
+}
+
+func (p httpPeer) ValuesOfHashes(ctx context.Context, bucket string, hashes [][32]byte) (values map[string][]byte, err error) {
+	req := valuesRequest{Bucket: bucket, Hashes: make([][]byte, len(hashes))}
+	for i := range hashes {
+		req.Hashes[i] = hashes[i][:]
+	}
+	err = p.do(ctx, http.MethodPost, "/hashes", req, &values)
+	return
+}
+
+func (p httpPeer) ValuesOfIDs(ctx context.Context, bucket string, ids [][idSize]byte) (values map[string][]byte, err error) {
+	req := valuesRequest{Bucket: bucket, IDs: make([][]byte, len(ids))}
+	for i := range ids {
+		req.IDs[i] = ids[i][:]
+	}
+	err = p.do(ctx, http.MethodPost, "/ids", req, &values)
+	return
+}
+
+func (p httpPeer) Changes(ctx context.Context, bucket string, since uint64, limit int) (changes []Change, err error) {
+	q := url.Values{"bucket": {bucket}, "since": {strconv.FormatUint(since, 10)}, "limit": {strconv.Itoa(limit)}}
+	err = p.do(ctx, http.MethodGet, "/changes?"+q.Encode(), nil, &changes)
+	return
+}
+
+func (p httpPeer) Seq(ctx context.Context, bucket string) (seq uint64, err error) {
+	err = p.do(ctx, http.MethodGet, "/seq?"+url.Values{"bucket": {bucket}}.Encode(), nil, &seq)
+	return
+}
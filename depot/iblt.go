@@ -0,0 +1,378 @@
+package depot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// An invertible Bloom lookup table (IBLT) holds a set of item hashes in a
+// fixed number of cells. The table of one side minus the table of the
+// other can be decoded into the items that only one side has, as long as
+// there are not many more of them than cells. A strata estimator, which is
+// a stack of small tables for the items with more and more trailing zero
+// bits, tells how large the table has to be.
+
+const (
+	// ibltHashes is the number of cells each item is added to
+	ibltHashes = 3
+	// strata is the number of tables of the estimator
+	strata = 32
+	// strataCells is the number of cells of each table of the estimator
+	strataCells = 81
+	cellSize    = 4 + 32 + 8
+	// maxSketchCells is the largest table that is sent
+	maxSketchCells = 1 << 20
+)
+
+// ErrDecode is returned when a table has too many items to be decoded.
+var ErrDecode = errors.New("depot: sketch could not be decoded")
+
+type cell struct {
+	count   int32
+	idSum   [32]byte
+	hashSum uint64
+}
+
+func checkHash(id [32]byte) uint64 {
+	h := sha256.Sum256(id[:])
+	return binary.LittleEndian.Uint64(h[:])
+}
+
+func (c *cell) toggle(id [32]byte, count int32) {
+	c.count += count
+	for i := range c.idSum {
+		c.idSum[i] ^= id[i]
+	}
+	c.hashSum ^= checkHash(id)
+}
+
+func (c *cell) empty() bool {
+	return c.count == 0 && c.idSum == [32]byte{} && c.hashSum == 0
+}
+
+func (c *cell) pure() bool {
+	return (c.count == 1 || c.count == -1) && c.hashSum == checkHash(c.idSum)
+}
+
+type iblt []cell
+
+// newIBLT returns a table with at least n cells.
+func newIBLT(n int) iblt {
+	if n < ibltHashes {
+		n = ibltHashes
+	}
+	return make(iblt, (n+ibltHashes-1)/ibltHashes*ibltHashes)
+}
+
+// positions returns a cell in each of the parts of the table.
+func (t iblt) positions(id [32]byte) (p [ibltHashes]int) {
+	part := len(t) / ibltHashes
+	for i := range p {
+		p[i] = i*part + int(binary.LittleEndian.Uint64(id[8*i:])%uint64(part))
+	}
+	return
+}
+
+func (t iblt) add(id [32]byte, count int32) {
+	for _, p := range t.positions(id) {
+		t[p].toggle(id, count)
+	}
+}
+
+// subtract takes the items of another table of the same size out.
+func (t iblt) subtract(other iblt) error {
+	if len(t) != len(other) {
+		return ErrDecode
+	}
+	for i := range t {
+		t[i].count -= other[i].count
+		for j := range t[i].idSum {
+			t[i].idSum[j] ^= other[i].idSum[j]
+		}
+		t[i].hashSum ^= other[i].hashSum
+	}
+	return nil
+}
+
+// decode peels the table, which is emptied, into the items that were
+// added and the items that were taken out.
+func (t iblt) decode() (added, removed [][32]byte, err error) {
+	var pure []int
+	for i := range t {
+		if t[i].pure() {
+			pure = append(pure, i)
+		}
+	}
+	for len(pure) > 0 {
+		i := pure[len(pure)-1]
+		pure = pure[:len(pure)-1]
+		if !t[i].pure() {
+			continue
+		}
+		id, count := t[i].idSum, t[i].count
+		if count > 0 {
+			added = append(added, id)
+		} else {
+			removed = append(removed, id)
+		}
+		for _, p := range t.positions(id) {
+			t[p].toggle(id, -count)
+			if t[p].pure() {
+				pure = append(pure, p)
+			}
+		}
+	}
+	for i := range t {
+		if !t[i].empty() {
+			err = ErrDecode
+			return
+		}
+	}
+	return
+}
+
+func (t iblt) encode() []byte {
+	b := make([]byte, 4, 4+len(t)*cellSize)
+	binary.BigEndian.PutUint32(b, uint32(len(t)))
+	for _, c := range t {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(c.count))
+		b = append(b, n[:]...)
+		b = append(b, c.idSum[:]...)
+		var h [8]byte
+		binary.BigEndian.PutUint64(h[:], c.hashSum)
+		b = append(b, h[:]...)
+	}
+	return b
+}
+
+func decodeIBLT(b []byte) (t iblt, rest []byte, err error) {
+	if len(b) < 4 {
+		err = ErrDecode
+		return
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if n == 0 || n%ibltHashes != 0 || uint64(len(b)) < uint64(n)*cellSize {
+		err = ErrDecode
+		return
+	}
+	t = make(iblt, n)
+	for i := range t {
+		t[i].count = int32(binary.BigEndian.Uint32(b))
+		copy(t[i].idSum[:], b[4:36])
+		t[i].hashSum = binary.BigEndian.Uint64(b[36:])
+		b = b[cellSize:]
+	}
+	rest = b
+	return
+}
+
+// estimator is a strata estimator.
+type estimator [strata]iblt
+
+func newEstimator() (e estimator) {
+	for i := range e {
+		e[i] = newIBLT(strataCells)
+	}
+	return
+}
+
+func (e estimator) add(id [32]byte) {
+	i := bits.TrailingZeros64(binary.LittleEndian.Uint64(id[24:]))
+	if i >= strata {
+		i = strata - 1
+	}
+	e[i].add(id, 1)
+}
+
+// estimate returns about how many items only one of the two has.
+func (e estimator) estimate(other estimator) int {
+	count := 0
+	for i := strata - 1; i >= 0; i-- {
+		t := append(iblt{}, e[i]...)
+		if t.subtract(other[i]) != nil {
+			return count
+		}
+		added, removed, err := t.decode()
+		if err != nil {
+			return (1 << uint(i+1)) * (count + 1)
+		}
+		count += len(added) + len(removed)
+	}
+	return count
+}
+
+func (e estimator) encode() (b []byte) {
+	for _, t := range e {
+		b = append(b, t.encode()...)
+	}
+	return
+}
+
+func decodeEstimator(b []byte) (e estimator, err error) {
+	for i := range e {
+		if e[i], b, err = decodeIBLT(b); err != nil {
+			return
+		}
+	}
+	if len(b) != 0 {
+		err = ErrDecode
+	}
+	return
+}
+
+// itemHashes returns the hash of every key and value of a bucket.
+func (db *DB) itemHashes(bucket string) (hashes map[[32]byte]string, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	hashes = make(map[[32]byte]string)
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			hashes[itemHash(k, content(v))] = string(k)
+			return nil
+		})
+	})
+	return
+}
+
+// sketch answers a strata estimator with a table of the bucket that is
+// large enough for the estimated difference.
+func (db *DB) sketch(bucket string, encodedEstimator []byte) (encodedIBLT []byte, err error) {
+	theirs, err := decodeEstimator(encodedEstimator)
+	if err != nil {
+		return
+	}
+	hashes, err := db.itemHashes(bucket)
+	if err != nil {
+		return
+	}
+	ours := newEstimator()
+	for h := range hashes {
+		ours.add(h)
+	}
+	// the estimate comes from the peer, so a table that is larger than the
+	// bucket could need is not made and the peer falls back to Sync
+	cells := 2*ours.estimate(theirs) + 30
+	if cells > 4*len(hashes)+100 || cells > maxSketchCells {
+		return nil, ErrDecode
+	}
+	t := newIBLT(cells)
+	for h := range hashes {
+		t.add(h, 1)
+	}
+	return t.encode(), nil
+}
+
+// valuesOfHashes returns the keys and values with the item hashes.
+func (db *DB) valuesOfHashes(bucket string, wanted [][32]byte) (values map[string][]byte, err error) {
+	hashes, err := db.itemHashes(bucket)
+	if err != nil {
+		return
+	}
+	keys := make([]string, 0, len(wanted))
+	for _, h := range wanted {
+		if key, ok := hashes[h]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return db.getValues(bucket, keys)
+}
+
+// SketchPeer is a Peer that can answer with sketches of its items.
+type SketchPeer interface {
+	Peer
+	// Sketch answers a strata estimator with an IBLT of the bucket
+	Sketch(ctx context.Context, bucket string, estimator []byte) (iblt []byte, err error)
+	// ValuesOfHashes returns the keys and values of the item hashes
+	ValuesOfHashes(ctx context.Context, bucket string, hashes [][32]byte) (values map[string][]byte, err error)
+}
+
+func (p localPeer) Sketch(ctx context.Context, bucket string, estimator []byte) ([]byte, error) {
+	return p.db.sketch(bucket, estimator)
+}
+
+func (p localPeer) ValuesOfHashes(ctx context.Context, bucket string, hashes [][32]byte) (map[string][]byte, error) {
+	return p.db.valuesOfHashes(bucket, hashes)
+}
+
+// SyncSketch will reconcile a bucket with a remote peer by sending a strata
+// estimator and decoding the IBLT that comes back, which takes one round
+// trip to find the difference however large it is. If the IBLT can not be
+// decoded it falls back to Sync.
+func SyncSketch(ctx context.Context, bucket string, local *DB, remote SketchPeer) (stats SyncStats, err error) {
+	hashes, err := local.itemHashes(bucket)
+	if err != nil {
+		return
+	}
+	e := newEstimator()
+	for h := range hashes {
+		e.add(h)
+	}
+	stats.Requests++
+	encoded, err := remote.Sketch(ctx, bucket, e.encode())
+	var t iblt
+	if err == nil {
+		var rest []byte
+		t, rest, err = decodeIBLT(encoded)
+		if err == nil && len(rest) != 0 {
+			err = ErrDecode
+		}
+	}
+	var pull, push [][32]byte
+	if err == nil {
+		ours := newIBLT(len(t))
+		for h := range hashes {
+			ours.add(h, 1)
+		}
+		if err = t.subtract(ours); err == nil {
+			pull, push, err = t.decode()
+		}
+	}
+	if err == ErrDecode {
+		var fallback SyncStats
+		fallback, err = Sync(ctx, bucket, local, remote)
+		fallback.Requests += stats.Requests
+		fallback.Fallback = true
+		return fallback, err
+	}
+	if err != nil {
+		return
+	}
+
+	// a key with different values is in both lists
+	var remoteValues map[string][]byte
+	if len(pull) > 0 {
+		stats.Requests++
+		remoteValues, err = remote.ValuesOfHashes(ctx, bucket, pull)
+		if err != nil {
+			return
+		}
+	}
+	var pushKeys []string
+	for _, h := range push {
+		if key, ok := hashes[h]; ok {
+			pushKeys = append(pushKeys, key)
+		}
+	}
+	values, err := reconcile(bucket, local, remoteValues, pushKeys, &stats)
+	if err != nil || len(values) == 0 {
+		return
+	}
+	stats.Requests++
+	if err = remote.SetValues(ctx, bucket, values); err != nil {
+		return
+	}
+	stats.Pushed = len(values)
+	return
+}
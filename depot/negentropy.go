@@ -0,0 +1,547 @@
+package depot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// This is range-based set reconciliation with the negentropy protocol
+// (version 1, https://github.com/hoytech/negentropy). Items are ordered by
+// timestamp and then by a 32 byte ID. Each message splits the ranges that
+// differ into many sub-ranges at once and sends the IDs of small ranges,
+// so one round trip resolves many ranges.
+
+const (
+	negentropyVersion = 0x61
+	idSize            = 32
+	fingerprintSize   = 16
+	// buckets is how many sub-ranges a range that differs is split into
+	buckets = 16
+
+	modeSkip        = 0
+	modeFingerprint = 1
+	modeIDList      = 2
+)
+
+// ErrNegentropy is returned for messages that can not be decoded.
+var ErrNegentropy = errors.New("depot: bad negentropy message")
+
+// Item is an element of a set that is reconciled with negentropy.
+type Item struct {
+	Timestamp uint64
+	ID        [idSize]byte
+}
+
+func (a Item) less(b Item) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// TimestampKey returns the key of an item, which sorts in the same order
+// as the items. Buckets that are reconciled with negentropy should use
+// these keys so the IDs and ranges match other implementations.
+func TimestampKey(timestamp uint64, id [idSize]byte) string {
+	return fmt.Sprintf("%016x%x", timestamp, id[:])
+}
+
+// keyItem returns the item of a key. Keys made by TimestampKey give their
+// timestamp and ID, and other keys have no timestamp and the SHA-256 of
+// the key as the ID.
+func keyItem(key string) (item Item) {
+	if len(key) == 16+2*idSize {
+		ts, err := hex.DecodeString(key[:16])
+		if err == nil {
+			if _, err = hex.Decode(item.ID[:], []byte(key[16:])); err == nil {
+				item.Timestamp = binary.BigEndian.Uint64(ts)
+				return
+			}
+		}
+	}
+	return Item{ID: sha256.Sum256([]byte(key))}
+}
+
+// bound is the upper end of a range. Only as much of the ID is sent as is
+// needed to tell the items apart, the rest is zero.
+type bound struct {
+	item      Item
+	prefixLen int
+}
+
+var maxBound = bound{item: Item{Timestamp: math.MaxUint64}}
+
+// minimalBound returns the shortest bound that is above prev and not
+// above curr.
+func minimalBound(prev, curr Item) bound {
+	if curr.Timestamp != prev.Timestamp {
+		return bound{item: Item{Timestamp: curr.Timestamp}}
+	}
+	shared := 0
+	for shared < idSize && prev.ID[shared] == curr.ID[shared] {
+		shared++
+	}
+	b := bound{item: Item{Timestamp: curr.Timestamp}, prefixLen: shared + 1}
+	copy(b.item.ID[:b.prefixLen], curr.ID[:])
+	return b
+}
+
+// negentropy is one side of a reconciliation over a sorted set of items.
+type negentropy struct {
+	items []Item
+	// sums[i] is the sum of the IDs of the first i items
+	sums           []accumulator
+	frameSizeLimit int
+	isInitiator    bool
+
+	// the timestamps of bounds are sent as differences
+	lastTimestampIn, lastTimestampOut uint64
+}
+
+// newNegentropy sorts the items. A frame size limit of 0 is no limit,
+// otherwise it has to be at least 4096 bytes.
+func newNegentropy(items []Item, frameSizeLimit int) (n *negentropy, err error) {
+	if frameSizeLimit != 0 && frameSizeLimit < 4096 {
+		err = errors.New("depot: frame size limit is too small")
+		return
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].less(items[j]) })
+	n = &negentropy{items: items, frameSizeLimit: frameSizeLimit}
+	n.sums = make([]accumulator, len(items)+1)
+	for i, item := range items {
+		n.sums[i+1] = n.sums[i]
+		n.sums[i+1].add(item.ID)
+	}
+	return
+}
+
+func (n *negentropy) fingerprint(lower, upper int) []byte {
+	sum := n.sums[upper]
+	sum.sub(n.sums[lower])
+	h := sha256.New()
+	h.Write(sum[:])
+	h.Write(encodeVarint(uint64(upper - lower)))
+	return h.Sum(nil)[:fingerprintSize]
+}
+
+// findLowerBound returns the index of the first item from first that is
+// not less than the bound.
+func (n *negentropy) findLowerBound(first int, b bound) int {
+	return first + sort.Search(len(n.items)-first, func(i int) bool {
+		return !n.items[first+i].less(b.item)
+	})
+}
+
+func (n *negentropy) exceeded(size int) bool {
+	return n.frameSizeLimit != 0 && size > n.frameSizeLimit-200
+}
+
+// initiate returns the first message of the initiator.
+func (n *negentropy) initiate() []byte {
+	n.isInitiator = true
+	n.lastTimestampOut = 0
+	out := []byte{negentropyVersion}
+	return n.splitRange(out, 0, len(n.items), maxBound)
+}
+
+// reconcile answers a message. The initiator gets the IDs that only it
+// has and the IDs that only the other side has, and is done when the
+// returned message is nil.
+func (n *negentropy) reconcile(query []byte) (out []byte, haveIDs, needIDs [][idSize]byte, err error) {
+	n.lastTimestampIn, n.lastTimestampOut = 0, 0
+	if len(query) == 0 {
+		err = ErrNegentropy
+		return
+	}
+	if query[0] != negentropyVersion {
+		if n.isInitiator || query[0] < 0x60 || query[0] > 0x6f {
+			err = fmt.Errorf("%w: unsupported protocol version 0x%x", ErrNegentropy, query[0])
+			return
+		}
+		// tell the initiator which version we speak
+		out = []byte{negentropyVersion}
+		return
+	}
+	query = query[1:]
+	out = []byte{negentropyVersion}
+
+	prevBound := bound{}
+	prevIndex := 0
+	skip := false
+	var o []byte
+	doSkip := func() {
+		if skip {
+			skip = false
+			o = n.encodeBound(o, prevBound)
+			o = appendVarint(o, modeSkip)
+		}
+	}
+
+	for len(query) > 0 {
+		var currBound bound
+		if currBound, query, err = n.decodeBound(query); err != nil {
+			return
+		}
+		var mode uint64
+		if mode, query, err = decodeVarint(query); err != nil {
+			return
+		}
+		lower := prevIndex
+		upper := n.findLowerBound(prevIndex, currBound)
+
+		switch mode {
+		case modeSkip:
+			skip = true
+		case modeFingerprint:
+			if len(query) < fingerprintSize {
+				err = ErrNegentropy
+				return
+			}
+			theirs := query[:fingerprintSize]
+			query = query[fingerprintSize:]
+			if bytes.Equal(theirs, n.fingerprint(lower, upper)) {
+				skip = true
+			} else {
+				doSkip()
+				o = n.splitRange(o, lower, upper, currBound)
+			}
+		case modeIDList:
+			var numIDs uint64
+			if numIDs, query, err = decodeVarint(query); err != nil {
+				return
+			}
+			if uint64(len(query)) < numIDs*idSize {
+				err = ErrNegentropy
+				return
+			}
+			theirs := make(map[[idSize]byte]bool, numIDs)
+			for i := uint64(0); i < numIDs; i++ {
+				var id [idSize]byte
+				copy(id[:], query[:idSize])
+				query = query[idSize:]
+				theirs[id] = true
+			}
+			for _, item := range n.items[lower:upper] {
+				if theirs[item.ID] {
+					delete(theirs, item.ID)
+				} else if n.isInitiator {
+					haveIDs = append(haveIDs, item.ID)
+				}
+			}
+			if n.isInitiator {
+				skip = true
+				for id := range theirs {
+					needIDs = append(needIDs, id)
+				}
+				break
+			}
+
+			doSkip()
+			var ids []byte
+			numResponseIDs := 0
+			endBound := currBound
+			for i := lower; i < upper; i++ {
+				if n.exceeded(len(out) + len(ids)) {
+					endBound = bound{item: n.items[i], prefixLen: idSize}
+					upper = i
+					break
+				}
+				ids = append(ids, n.items[i].ID[:]...)
+				numResponseIDs++
+			}
+			o = n.encodeBound(o, endBound)
+			o = appendVarint(o, modeIDList)
+			o = appendVarint(o, uint64(numResponseIDs))
+			o = append(o, ids...)
+			out = append(out, o...)
+			o = o[:0]
+		default:
+			err = fmt.Errorf("%w: unknown mode %d", ErrNegentropy, mode)
+			return
+		}
+
+		if n.exceeded(len(out) + len(o)) {
+			// the rest of the ranges are sent again next time
+			remaining := n.fingerprint(upper, len(n.items))
+			out = n.encodeBound(out, maxBound)
+			out = appendVarint(out, modeFingerprint)
+			out = append(out, remaining...)
+			break
+		}
+		out = append(out, o...)
+		o = o[:0]
+
+		prevIndex = upper
+		prevBound = currBound
+	}
+
+	if n.isInitiator && len(out) == 1 {
+		out = nil
+	}
+	return
+}
+
+// splitRange appends the ID list of a small range or the fingerprints of
+// the sub-ranges of a large one.
+func (n *negentropy) splitRange(o []byte, lower, upper int, upperBound bound) []byte {
+	numElems := upper - lower
+	if numElems < buckets*2 {
+		o = n.encodeBound(o, upperBound)
+		o = appendVarint(o, modeIDList)
+		o = appendVarint(o, uint64(numElems))
+		for _, item := range n.items[lower:upper] {
+			o = append(o, item.ID[:]...)
+		}
+		return o
+	}
+
+	itemsPerBucket := numElems / buckets
+	bucketsWithExtra := numElems % buckets
+	curr := lower
+	for i := 0; i < buckets; i++ {
+		bucketSize := itemsPerBucket
+		if i < bucketsWithExtra {
+			bucketSize++
+		}
+		fp := n.fingerprint(curr, curr+bucketSize)
+		curr += bucketSize
+
+		nextBound := upperBound
+		if curr != upper {
+			nextBound = minimalBound(n.items[curr-1], n.items[curr])
+		}
+		o = n.encodeBound(o, nextBound)
+		o = appendVarint(o, modeFingerprint)
+		o = append(o, fp...)
+	}
+	return o
+}
+
+func (n *negentropy) encodeBound(o []byte, b bound) []byte {
+	if b.item.Timestamp == math.MaxUint64 {
+		n.lastTimestampOut = math.MaxUint64
+		o = appendVarint(o, 0)
+	} else {
+		delta := b.item.Timestamp - n.lastTimestampOut
+		n.lastTimestampOut = b.item.Timestamp
+		o = appendVarint(o, delta+1)
+	}
+	o = appendVarint(o, uint64(b.prefixLen))
+	return append(o, b.item.ID[:b.prefixLen]...)
+}
+
+func (n *negentropy) decodeBound(in []byte) (b bound, rest []byte, err error) {
+	timestamp, rest, err := decodeVarint(in)
+	if err != nil {
+		return
+	}
+	if timestamp == 0 {
+		timestamp = math.MaxUint64
+	} else {
+		timestamp--
+		if timestamp > math.MaxUint64-n.lastTimestampIn {
+			timestamp = math.MaxUint64
+		} else {
+			timestamp += n.lastTimestampIn
+		}
+	}
+	n.lastTimestampIn = timestamp
+	b.item.Timestamp = timestamp
+
+	prefixLen, rest, err := decodeVarint(rest)
+	if err != nil {
+		return
+	}
+	if prefixLen > idSize || uint64(len(rest)) < prefixLen {
+		err = ErrNegentropy
+		return
+	}
+	b.prefixLen = int(prefixLen)
+	copy(b.item.ID[:], rest[:prefixLen])
+	rest = rest[prefixLen:]
+	return
+}
+
+// Varints are base 128 with the most significant digit first, and the
+// high bit set on all but the last byte.
+
+func encodeVarint(v uint64) []byte {
+	return appendVarint(nil, v)
+}
+
+func appendVarint(o []byte, v uint64) []byte {
+	var digits [10]byte
+	i := len(digits) - 1
+	digits[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		digits[i] = byte(v&0x7f) | 0x80
+	}
+	return append(o, digits[i:]...)
+}
+
+func decodeVarint(in []byte) (v uint64, rest []byte, err error) {
+	for i, b := range in {
+		if v > math.MaxUint64>>7 {
+			break
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, in[i+1:], nil
+		}
+	}
+	err = ErrNegentropy
+	return
+}
+
+// negentropyItems returns the items of a bucket, with the keys of the IDs.
+func (db *DB) negentropyItems(bucket string) (items []Item, keys map[[idSize]byte]string, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	keys = make(map[[idSize]byte]string)
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			item := keyItem(string(k))
+			items = append(items, item)
+			keys[item.ID] = string(k)
+			return nil
+		})
+	})
+	return
+}
+
+// NegentropyFrameSizeLimit is the largest message that is sent when
+// answering negentropy messages, 0 for no limit.
+var NegentropyFrameSizeLimit = 60000
+
+// NegentropyPeer is a Peer that can answer negentropy messages.
+type NegentropyPeer interface {
+	Peer
+	// Negentropy answers a negentropy message about the bucket
+	Negentropy(ctx context.Context, bucket string, query []byte) (response []byte, err error)
+	// ValuesOfIDs returns the keys and values of the items with the IDs
+	ValuesOfIDs(ctx context.Context, bucket string, ids [][idSize]byte) (values map[string][]byte, err error)
+}
+
+// respondNegentropy answers a negentropy message about a bucket.
+func (db *DB) respondNegentropy(bucket string, query []byte) (response []byte, err error) {
+	items, _, err := db.negentropyItems(bucket)
+	if err != nil {
+		return
+	}
+	n, err := newNegentropy(items, NegentropyFrameSizeLimit)
+	if err != nil {
+		return
+	}
+	response, _, _, err = n.reconcile(query)
+	return
+}
+
+// valuesOfIDs returns the keys and values of the items with the IDs.
+func (db *DB) valuesOfIDs(bucket string, ids [][idSize]byte) (values map[string][]byte, err error) {
+	_, keys, err := db.negentropyItems(bucket)
+	if err != nil {
+		return
+	}
+	wanted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if key, ok := keys[id]; ok {
+			wanted = append(wanted, key)
+		}
+	}
+	return db.getValues(bucket, wanted)
+}
+
+func (p localPeer) Negentropy(ctx context.Context, bucket string, query []byte) ([]byte, error) {
+	return p.db.respondNegentropy(bucket, query)
+}
+
+func (p localPeer) ValuesOfIDs(ctx context.Context, bucket string, ids [][idSize]byte) (map[string][]byte, error) {
+	return p.db.valuesOfIDs(bucket, ids)
+}
+
+// SyncNegentropy will reconcile a bucket with a remote peer using the
+// negentropy protocol, which takes fewer round trips than Sync. The items
+// are the keys, as in other implementations, so the keys that both have
+// are then compared with Sync, which finds the values that differ and the
+// deletes. When they are the same that is one more request.
+// A frame size limit of 0 is no limit, otherwise it is at least 4096.
+func SyncNegentropy(ctx context.Context, bucket string, local *DB, remote NegentropyPeer, frameSizeLimit int) (stats SyncStats, err error) {
+	items, keys, err := local.negentropyItems(bucket)
+	if err != nil {
+		return
+	}
+	n, err := newNegentropy(items, frameSizeLimit)
+	if err != nil {
+		return
+	}
+
+	var haveIDs, needIDs [][idSize]byte
+	for msg := n.initiate(); msg != nil; {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		stats.Requests++
+		var response []byte
+		response, err = remote.Negentropy(ctx, bucket, msg)
+		if err != nil {
+			return
+		}
+		var have, need [][idSize]byte
+		msg, have, need, err = n.reconcile(response)
+		if err != nil {
+			return
+		}
+		haveIDs = append(haveIDs, have...)
+		needIDs = append(needIDs, need...)
+	}
+
+	if len(needIDs) > 0 {
+		stats.Requests++
+		var values map[string][]byte
+		values, err = remote.ValuesOfIDs(ctx, bucket, needIDs)
+		if err != nil {
+			return
+		}
+		if err = local.setValues(bucket, values); err != nil {
+			return
+		}
+		stats.Pulled = len(values)
+	}
+	if len(haveIDs) > 0 {
+		push := make([]string, len(haveIDs))
+		for i, id := range haveIDs {
+			push[i] = keys[id]
+		}
+		var values map[string][]byte
+		values, err = local.getValues(bucket, push)
+		if err != nil {
+			return
+		}
+		stats.Requests++
+		if err = remote.SetValues(ctx, bucket, values); err != nil {
+			return
+		}
+		stats.Pushed = len(values)
+	}
+
+	versions, err := Sync(ctx, bucket, local, remote)
+	stats.Pulled += versions.Pulled
+	stats.Pushed += versions.Pushed
+	stats.Requests += versions.Requests
+	stats.Conflicts += versions.Conflicts
+	return
+}
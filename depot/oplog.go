@@ -0,0 +1,268 @@
+package depot
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every write to a bucket is also appended to the log of the bucket, with
+// a sequence number that only goes up, so that a follower that knows where
+// it stopped can ask for the changes since then instead of reconciling the
+// whole bucket. The log is a bolt bucket next to the bucket, where the key
+// is the sequence number and the value is the length of the key, the key
+// and the stored value.
+
+// ChangesLimit is the number of changes that SyncChanges asks for at once.
+const ChangesLimit = 1000
+
+// DefaultLogSize is the number of changes that the log of a bucket keeps
+// unless it is changed with WithLogSize.
+const DefaultLogSize = 100000
+
+// WithLogSize sets the number of changes that the log of every bucket
+// keeps, where 0 keeps every change.
+func WithLogSize(n uint64) Option {
+	return func(db *DB) error {
+		db.logSize = n
+		return nil
+	}
+}
+
+// ErrTruncated is returned when the changes that are asked for are no
+// longer in the log.
+var ErrTruncated = errors.New("depot: changes are no longer in the log")
+
+// Change is an entry of the log of a bucket.
+type Change struct {
+	Seq uint64 `json:"seq"`
+	Key string `json:"key"`
+	// Value is the stored value with its version
+	Value []byte `json:"value"`
+}
+
+// Versioned returns the value of the change.
+func (c Change) Versioned() Versioned {
+	return decodeVersioned(c.Value)
+}
+
+func logName(bucket string) []byte {
+	return []byte("\x00log\x00" + bucket)
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// logBucket returns the log of the bucket, making it if needed. A log that
+// is made for a bucket that already has keys starts truncated, since their
+// changes are not in it.
+func logBucket(tx *bolt.Tx, bucket string) (l *bolt.Bucket, err error) {
+	if l = tx.Bucket(logName(bucket)); l != nil {
+		return
+	}
+	l, err = tx.CreateBucket(logName(bucket))
+	if err != nil {
+		return
+	}
+	if b := tx.Bucket([]byte(bucket)); b != nil {
+		if k, _ := b.Cursor().First(); k != nil {
+			err = l.SetSequence(1)
+		}
+	}
+	return
+}
+
+// appendLog adds a change to the log of the bucket and removes the ones
+// that are more than the log size before it.
+func (db *DB) appendLog(tx *bolt.Tx, bucket string, key, value []byte) (seq uint64, err error) {
+	l, err := logBucket(tx, bucket)
+	if err != nil {
+		return
+	}
+	seq, err = l.NextSequence()
+	if err != nil {
+		return
+	}
+	entry := make([]byte, 4, 4+len(key)+len(value))
+	binary.BigEndian.PutUint32(entry, uint32(len(key)))
+	entry = append(entry, key...)
+	entry = append(entry, value...)
+	if err = l.Put(seqKey(seq), entry); err != nil || db.logSize == 0 || seq <= db.logSize {
+		return
+	}
+	c := l.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq-db.logSize; k, _ = c.First() {
+		if err = c.Delete(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func decodeChange(k, v []byte) (c Change, err error) {
+	if len(k) != 8 || len(v) < 4 || uint64(len(v)-4) < uint64(binary.BigEndian.Uint32(v)) {
+		err = fmt.Errorf("depot: bad log entry")
+		return
+	}
+	n := 4 + int(binary.BigEndian.Uint32(v))
+	c.Seq = binary.BigEndian.Uint64(k)
+	c.Key = string(v[4:n])
+	c.Value = append([]byte{}, v[n:]...)
+	return
+}
+
+// firstSeq returns the first sequence number that is still in the log.
+func firstSeq(l *bolt.Bucket) uint64 {
+	if k, _ := l.Cursor().First(); k != nil {
+		return binary.BigEndian.Uint64(k)
+	}
+	return l.Sequence() + 1
+}
+
+// Changes returns up to limit changes of the bucket after the sequence
+// number since, or every one of them for a limit of 0. It returns
+// ErrTruncated when some of them are no longer in the log.
+func (db *DB) Changes(bucket string, since uint64, limit int) (changes []Change, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	changes = []Change{}
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		l := tx.Bucket(logName(bucket))
+		if l == nil {
+			if k, _ := b.Cursor().First(); k != nil {
+				return ErrTruncated
+			}
+			return nil
+		}
+		if since+1 < firstSeq(l) {
+			return ErrTruncated
+		}
+		c := l.Cursor()
+		for k, v := c.Seek(seqKey(since + 1)); k != nil; k, v = c.Next() {
+			if limit > 0 && len(changes) == limit {
+				break
+			}
+			change, err := decodeChange(k, v)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return
+}
+
+// Seq returns the sequence number of the last change of the bucket.
+func (db *DB) Seq(bucket string) (seq uint64, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	err = db.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucket)) == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		if l := tx.Bucket(logName(bucket)); l != nil {
+			seq = l.Sequence()
+		}
+		return nil
+	})
+	return
+}
+
+// TruncateLog removes the changes of the bucket before the sequence
+// number. A follower that has not seen them has to Sync instead.
+func (db *DB) TruncateLog(bucket string, before uint64) (deleted int, err error) {
+	db.Lock()
+	defer db.Unlock()
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		l, err := logBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		c := l.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < before; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return
+}
+
+// LogPeer is a Peer that can send the changes in its log.
+type LogPeer interface {
+	Peer
+	// Changes returns up to limit changes after the sequence number since
+	Changes(ctx context.Context, bucket string, since uint64, limit int) (changes []Change, err error)
+	// Seq returns the sequence number of the last change
+	Seq(ctx context.Context, bucket string) (seq uint64, err error)
+}
+
+func (p localPeer) Changes(ctx context.Context, bucket string, since uint64, limit int) ([]Change, error) {
+	return p.db.Changes(bucket, since, limit)
+}
+
+func (p localPeer) Seq(ctx context.Context, bucket string) (uint64, error) {
+	return p.db.Seq(bucket)
+}
+
+// SyncChanges pulls the changes of a bucket that the remote peer made
+// after the sequence number since, and returns the sequence number to
+// start from next time, which is before the first change with a clock
+// too far ahead. When the changes are no longer in the log of the remote
+// it falls back to Sync.
+func SyncChanges(ctx context.Context, bucket string, local *DB, remote LogPeer, since uint64) (stats SyncStats, seq uint64, err error) {
+	seq = since
+	for {
+		var changes []Change
+		stats.Requests++
+		changes, err = remote.Changes(ctx, bucket, seq, ChangesLimit)
+		if err == ErrTruncated {
+			// the changes during the Sync are pulled next time
+			stats.Requests++
+			seq, err = remote.Seq(ctx, bucket)
+			if err != nil {
+				return
+			}
+			var fallback SyncStats
+			fallback, err = Sync(ctx, bucket, local, remote)
+			fallback.Requests += stats.Requests
+			fallback.Fallback = true
+			return fallback, seq, err
+		}
+		if err != nil || len(changes) == 0 {
+			return
+		}
+		values := make(map[string][]byte, len(changes))
+		for _, c := range changes {
+			values[c.Key] = c.Value
+		}
+		var ahead map[string]bool
+		if ahead, err = local.storeValues(bucket, values); err != nil {
+			return
+		}
+		stats.Pulled += len(values) - len(ahead)
+		for _, c := range changes {
+			if ahead[c.Key] {
+				// it is pulled again once the clocks are closer
+				return
+			}
+			seq = c.Seq
+		}
+		if len(changes) < ChangesLimit {
+			return
+		}
+	}
+}
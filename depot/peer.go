@@ -0,0 +1,121 @@
+package depot
+
+import (
+	"context"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Peer is the other side of a Sync. Ranges go from first up to but not
+// including last, where "first" and "last" are the ends of the bucket.
+type Peer interface {
+	// RangeHash returns the fingerprint of the range, the key in the
+	// middle of it and the number of keys in it
+	RangeHash(ctx context.Context, bucket, first, last string) (rangeHash string, middleKey string, count int, err error)
+	// Keys returns the keys in the range, including the deleted ones
+	Keys(ctx context.Context, bucket, first, last string) (keys []string, err error)
+	// Values returns the stored values of the keys that exist
+	Values(ctx context.Context, bucket string, keys []string) (values map[string][]byte, err error)
+	// SetValues stores the values, merging them with the values of the
+	// keys that it has
+	SetValues(ctx context.Context, bucket string, values map[string][]byte) error
+}
+
+// localPeer is a Peer for a DB in the same process.
+type localPeer struct {
+	db *DB
+}
+
+// NewPeer returns a Peer for a DB in the same process.
+func NewPeer(db *DB) Peer {
+	return localPeer{db}
+}
+
+func (p localPeer) RangeHash(ctx context.Context, bucket, first, last string) (string, string, int, error) {
+	return p.db.getRangeOfHashes(bucket, first, last)
+}
+
+func (p localPeer) Keys(ctx context.Context, bucket, first, last string) ([]string, error) {
+	return p.db.keysInRange(bucket, first, last, true)
+}
+
+func (p localPeer) Values(ctx context.Context, bucket string, keys []string) (map[string][]byte, error) {
+	return p.db.getValues(bucket, keys)
+}
+
+func (p localPeer) SetValues(ctx context.Context, bucket string, values map[string][]byte) error {
+	return p.db.setValues(bucket, values)
+}
+
+// getValues returns the stored JSON of the keys that exist.
+func (db *DB) getValues(bucket string, keys []string) (values map[string][]byte, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	values = make(map[string][]byte, len(keys))
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		for _, key := range keys {
+			if v := b.Get([]byte(key)); v != nil {
+				values[key] = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// setValues stores values that were already encoded, merging them with
+// the values of the keys that exist. Values with clocks too far ahead are
+// left out.
+func (db *DB) setValues(bucket string, values map[string][]byte) (err error) {
+	_, err = db.storeValues(bucket, values)
+	return
+}
+
+// storeValues is setValues, and returns the keys of the values that were
+// left out since their clocks were too far ahead.
+func (db *DB) storeValues(bucket string, values map[string][]byte) (ahead map[string]bool, err error) {
+	db.Lock()
+	defer db.Unlock()
+	ahead = make(map[string]bool)
+	stored := make(map[string][]byte, len(values))
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		for key, value := range values {
+			if !db.clock.observe(decodeVersioned(value).Clock) {
+				ahead[key] = true
+				continue
+			}
+			if existing := b.Get([]byte(key)); existing != nil {
+				value = db.merge(bucket, key, existing, value)
+				if sameContent(value, existing) {
+					continue
+				}
+			}
+			if _, err := db.appendLog(tx, bucket, []byte(key), value); err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+			stored[key] = value
+		}
+		return nil
+	})
+	if err == nil {
+		for key, value := range stored {
+			db.treeSet(bucket, key, value)
+		}
+		if len(stored) > 0 {
+			db.wake(bucket)
+		}
+	}
+	return
+}
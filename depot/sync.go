@@ -1,118 +1,215 @@
 package depot
 
 import (
-	"bytes"
-	"fmt"
-	"hash/adler32"
-
-	bolt "go.etcd.io/bbolt"
+	"context"
 )
 
+// getRangeOfHashes returns the fingerprint of the keys and values in the
+// range, the key in the middle of the range and the number of keys.
 func (db *DB) getRangeOfHashes(bucket, first, last string) (rangeHash string, middleKey string, count int, err error) {
 	db.RLock()
 	defer db.RUnlock()
+	t, err := db.getTree(bucket)
+	if err != nil {
+		return
+	}
+	rangeHash, middleKey, count = t.rangeOf(first, last)
+	return
+}
 
-	a32 := adler32.New()
-	count = 0
-	err = db.db.View(func(tx *bolt.Tx) error {
-		// Assume our events bucket exists and has RFC3339 encoded time keys.
-		b := tx.Bucket([]byte(bucket))
-		if b == nil {
-			return fmt.Errorf("bucket '%s' does not exist", bucket)
-		}
-		c := b.Cursor()
+func (db *DB) checkRangeOfHashes(bucket, first, last, rangeHashFromOtherDB string) (isEqual bool, err error) {
+	rangeHash, _, _, err := db.getRangeOfHashes(bucket, first, last)
+	if err != nil {
+		return
+	}
+	isEqual = rangeHash == rangeHashFromOtherDB
+	return
+}
 
-		// Our time range spans the 90's decade.
-		min := []byte(first)
-		max := []byte(last)
+// SyncStats are the numbers of a Sync.
+type SyncStats struct {
+	// Pulled is the number of values copied from the remote
+	Pulled int
+	// Pushed is the number of values copied to the remote
+	Pushed int
+	// Requests is the number of calls to the remote
+	Requests int
+	// Conflicts is the number of keys that both have with different values,
+	// which are merged by the MergeFunc of the bucket
+	Conflicts int
+	// Fallback is set when SyncSketch or SyncChanges had to fall back to
+	// Sync
+	Fallback bool
+}
 
-		if first == "first" && last == "last" {
-			for k, _ := c.First(); k != nil; k, _ = c.Next() {
-				a32.Write(k)
-				count++
-			}
-		} else if first == "first" {
-			for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
-				a32.Write(k)
-				count++
-			}
-		} else if last == "last" {
-			for k, _ := c.Seek(min); k != nil; k, _ = c.Next() {
-				a32.Write(k)
-				count++
-			}
-		} else {
-			for k, _ := c.Seek(min); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
-				a32.Write(k)
-				count++
-			}
-		}
+// keyRange is a range of keys from first up to but not including last.
+type keyRange struct {
+	first string
+	last  string
+}
 
-		return nil
-	})
+// Sync will reconcile a bucket with a remote peer, so that afterwards both
+// have every key. The ranges that differ are found by bisection of the
+// range fingerprints and then the missing values are copied both ways.
+func Sync(ctx context.Context, bucket string, local *DB, remote Peer) (stats SyncStats, err error) {
+	s := &syncer{ctx: ctx, bucket: bucket, local: local, remote: remote}
+	ranges, err := s.find(keyRange{"first", "last"}, nil)
 	if err != nil {
 		return
 	}
-	rangeHash = fmt.Sprintf("%x", a32.Sum32())
-
-	err = db.db.View(func(tx *bolt.Tx) error {
-		// Assume our events bucket exists and has RFC3339 encoded time keys.
-		b := tx.Bucket([]byte(bucket))
-		if b == nil {
-			return fmt.Errorf("bucket '%s' does not exist", bucket)
+	for _, r := range mergeRanges(ranges) {
+		if err = s.exchange(r); err != nil {
+			break
 		}
-		c := b.Cursor()
+	}
+	stats = s.stats
+	return
+}
 
-		// Our time range spans the 90's decade.
-		min := []byte(first)
-		max := []byte(last)
+type syncer struct {
+	ctx    context.Context
+	bucket string
+	local  *DB
+	remote Peer
+	stats  SyncStats
+}
 
-		cur := 0
+// find returns the ranges that are different, splitting them at the
+// middle key until they have at most one key locally.
+func (s *syncer) find(r keyRange, ranges []keyRange) ([]keyRange, error) {
+	if err := s.ctx.Err(); err != nil {
+		return ranges, err
+	}
+	rangeHash, middleKey, count, err := s.local.getRangeOfHashes(s.bucket, r.first, r.last)
+	if err != nil {
+		return ranges, err
+	}
+	s.stats.Requests++
+	remoteHash, _, remoteCount, err := s.remote.RangeHash(s.ctx, s.bucket, r.first, r.last)
+	if err != nil {
+		return ranges, err
+	}
+	if err = checkFingerprint(remoteHash); err != nil {
+		return ranges, err
+	}
+	if rangeHash == remoteHash && count == remoteCount {
+		return ranges, nil
+	}
+	if count <= 1 {
+		return append(ranges, r), nil
+	}
+	ranges, err = s.find(keyRange{r.first, middleKey}, ranges)
+	if err != nil {
+		return ranges, err
+	}
+	return s.find(keyRange{middleKey, r.last}, ranges)
+}
 
-		if first == "first" && last == "last" {
-			for k, _ := c.First(); k != nil; k, _ = c.Next() {
-				if cur == count/2 {
-					middleKey = string(k)
-					return nil
-				}
-				cur++
-			}
-		} else if first == "first" {
-			for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
-				if cur == count/2 {
-					middleKey = string(k)
-					return nil
-				}
-				cur++
-			}
-		} else if last == "last" {
-			for k, _ := c.Seek(min); k != nil; k, _ = c.Next() {
-				if cur == count/2 {
-					middleKey = string(k)
-					return nil
-				}
-				cur++
+// mergeRanges joins ranges that are next to each other.
+func mergeRanges(ranges []keyRange) (merged []keyRange) {
+	for _, r := range ranges {
+		if len(merged) > 0 && merged[len(merged)-1].last == r.first {
+			merged[len(merged)-1].last = r.last
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return
+}
+
+// exchange copies the keys that only one side has in the range and merges
+// the keys that both have with different values.
+func (s *syncer) exchange(r keyRange) (err error) {
+	localKeys, err := s.local.keysInRange(s.bucket, r.first, r.last, true)
+	if err != nil {
+		return
+	}
+	s.stats.Requests++
+	remoteKeys, err := s.remote.Keys(s.ctx, s.bucket, r.first, r.last)
+	if err != nil {
+		return
+	}
+	pull, push := difference(remoteKeys, localKeys), difference(localKeys, remoteKeys)
+	// the keys that both have are fetched too, to find the conflicts
+	both := difference(localKeys, push)
+
+	pulled := map[string][]byte{}
+	if len(pull)+len(both) > 0 {
+		s.stats.Requests++
+		var remoteValues map[string][]byte
+		remoteValues, err = s.remote.Values(s.ctx, s.bucket, append(pull, both...))
+		if err != nil {
+			return
+		}
+		var localValues map[string][]byte
+		localValues, err = s.local.getValues(s.bucket, both)
+		if err != nil {
+			return
+		}
+		for _, key := range pull {
+			if value, ok := remoteValues[key]; ok {
+				pulled[key] = value
 			}
-		} else {
-			for k, _ := c.Seek(min); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
-				if cur == count/2 {
-					middleKey = string(k)
-					return nil
-				}
-				cur++
+		}
+		for _, key := range both {
+			if value, ok := remoteValues[key]; ok && !sameContent(localValues[key], value) {
+				pulled[key] = value
+				push = append(push, key)
 			}
 		}
-
-		return nil
-	})
+	}
+	values, err := reconcile(s.bucket, s.local, pulled, push, &s.stats)
+	if err != nil || len(values) == 0 {
+		return
+	}
+	s.stats.Requests++
+	if err = s.remote.SetValues(s.ctx, s.bucket, values); err != nil {
+		return
+	}
+	s.stats.Pushed += len(values)
 	return
 }
 
-func (db *DB) checkRangeOfHashes(bucket, first, last, rangeHashFromOtherDB string) (isEqual bool, err error) {
-	rangeHash, _, _, err := db.getRangeOfHashes(bucket, first, last)
+// reconcile stores the values pulled from the remote, merging the keys that
+// are also in push, and returns the values of push that the remote does
+// not have yet.
+func reconcile(bucket string, local *DB, pulled map[string][]byte, push []string, stats *SyncStats) (values map[string][]byte, err error) {
+	for _, key := range push {
+		if _, ok := pulled[key]; ok {
+			stats.Conflicts++
+		}
+	}
+	if err = local.setValues(bucket, pulled); err != nil {
+		return
+	}
+	values, err = local.getValues(bucket, push)
 	if err != nil {
 		return
 	}
-	isEqual = rangeHash == rangeHashFromOtherDB
+	for key, value := range pulled {
+		if sameContent(values[key], value) {
+			delete(values, key)
+		}
+	}
+	for _, key := range push {
+		if _, ok := values[key]; ok {
+			delete(pulled, key)
+		}
+	}
+	stats.Pulled += len(pulled)
+	return
+}
+
+// difference returns the keys in a that are not in b.
+func difference(a, b []string) (diff []string) {
+	inB := make(map[string]bool, len(b))
+	for _, key := range b {
+		inB[key] = true
+	}
+	for _, key := range a {
+		if !inB[key] {
+			diff = append(diff, key)
+		}
+	}
 	return
 }
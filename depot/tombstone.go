@@ -0,0 +1,82 @@
+package depot
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A deleted key keeps a tombstone as its value, so that the delete is in
+// the fingerprints and is copied by sync like any other value instead of
+// the key coming back from a peer that still has it. A tombstone is a
+// version without a value.
+
+// DefaultTombstoneHorizon is how long a tombstone is kept by default. A
+// peer that has not synced for longer may bring the key back.
+const DefaultTombstoneHorizon = 30 * 24 * time.Hour
+
+// tombstone returns a new tombstone of this node.
+func (db *DB) tombstone() []byte {
+	return encodeVersioned(Versioned{Version: Version{db.clock.now(), db.node}, Deleted: true})
+}
+
+func isTombstone(value []byte) bool {
+	return decodeVersioned(value).Deleted
+}
+
+// keysInRange returns the keys in the range, with the tombstones if asked.
+func (db *DB) keysInRange(bucket, first, last string, tombstones bool) (keys []string, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	keys = []string{}
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		eachInRange(b.Cursor(), first, last, func(k, v []byte) bool {
+			if tombstones || !isTombstone(v) {
+				keys = append(keys, string(k))
+			}
+			return true
+		})
+		return nil
+	})
+	return
+}
+
+// DeleteTombstones removes the tombstones in the bucket that are older
+// than the horizon.
+func (db *DB) DeleteTombstones(bucket string, horizon time.Duration) (deleted int, err error) {
+	db.Lock()
+	defer db.Unlock()
+	before := time.Now().Add(-horizon)
+	var old [][]byte
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		old = nil
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if isTombstone(v) && decodeVersioned(v).Clock.Time().Before(before) {
+				old = append(old, append([]byte{}, k...))
+			}
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(old)
+		return nil
+	})
+	if err == nil {
+		for _, k := range old {
+			db.treeDelete(bucket, string(k))
+		}
+	}
+	return
+}
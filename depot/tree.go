@@ -0,0 +1,234 @@
+package depot
+
+import (
+	"fmt"
+	"math/rand"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The fingerprints of each bucket are kept in a treap, which is a balanced
+// binary search tree where every node has the count and the fingerprint
+// of its subtree. The count, fingerprint and middle key of any range take
+// O(log n), instead of a walk over the range. The tree of a bucket is built
+// from the bucket the first time it is needed and is then updated on every
+// change to the bucket.
+
+type node struct {
+	key         string
+	hash        [32]byte
+	priority    uint32
+	left, right *node
+	// size and sum are for the subtree
+	size int
+	sum  accumulator
+}
+
+func (n *node) update() {
+	n.size = 1
+	n.sum = accumulator{}
+	if n.left != nil {
+		n.size += n.left.size
+		n.sum.add(n.left.sum)
+	}
+	n.sum.add(n.hash)
+	if n.right != nil {
+		n.size += n.right.size
+		n.sum.add(n.right.sum)
+	}
+}
+
+func insert(n *node, key string, hash [32]byte) *node {
+	if n == nil {
+		n = &node{key: key, hash: hash, priority: rand.Uint32()}
+		n.update()
+		return n
+	}
+	switch {
+	case key < n.key:
+		n.left = insert(n.left, key, hash)
+		if n.left.priority > n.priority {
+			l := n.left
+			n.left = l.right
+			n.update()
+			l.right = n
+			n = l
+		}
+	case key > n.key:
+		n.right = insert(n.right, key, hash)
+		if n.right.priority > n.priority {
+			r := n.right
+			n.right = r.left
+			n.update()
+			r.left = n
+			n = r
+		}
+	default:
+		n.hash = hash
+	}
+	n.update()
+	return n
+}
+
+func remove(n *node, key string) *node {
+	if n == nil {
+		return nil
+	}
+	switch {
+	case key < n.key:
+		n.left = remove(n.left, key)
+	case key > n.key:
+		n.right = remove(n.right, key)
+	default:
+		return merge(n.left, n.right)
+	}
+	n.update()
+	return n
+}
+
+// merge joins two trees where every key of a is less than those of b.
+func merge(a, b *node) *node {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = merge(a, b.left)
+	b.update()
+	return b
+}
+
+// prefix returns the count and fingerprint of the keys less than key.
+func prefix(n *node, key string) (count int, sum accumulator) {
+	for n != nil {
+		if n.key < key {
+			if n.left != nil {
+				count += n.left.size
+				sum.add(n.left.sum)
+			}
+			count++
+			sum.add(n.hash)
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return
+}
+
+// nth returns the key at position i.
+func nth(n *node, i int) string {
+	for n != nil {
+		left := 0
+		if n.left != nil {
+			left = n.left.size
+		}
+		switch {
+		case i < left:
+			n = n.left
+		case i == left:
+			return n.key
+		default:
+			i -= left + 1
+			n = n.right
+		}
+	}
+	return ""
+}
+
+// tree is the treap of a bucket.
+type tree struct {
+	root *node
+}
+
+func (t *tree) set(key string, value []byte) {
+	t.root = insert(t.root, key, itemHash([]byte(key), content(value)))
+}
+
+func (t *tree) delete(key string) {
+	t.root = remove(t.root, key)
+}
+
+// bound returns the prefix of an end of a range.
+func (t *tree) bound(key string) (count int, sum accumulator) {
+	switch key {
+	case "first":
+		return
+	case "last":
+		if t.root != nil {
+			return t.root.size, t.root.sum
+		}
+		return
+	}
+	return prefix(t.root, key)
+}
+
+// rangeOf returns the fingerprint, middle key and count of the range.
+func (t *tree) rangeOf(first, last string) (rangeHash string, middleKey string, count int) {
+	lo, loSum := t.bound(first)
+	hi, hiSum := t.bound(last)
+	if hi < lo {
+		hi, hiSum = lo, loSum
+	}
+	count = hi - lo
+	hiSum.sub(loSum)
+	rangeHash = hiSum.fingerprint()
+	if count > 0 {
+		middleKey = nth(t.root, lo+count/2)
+	}
+	return
+}
+
+// getTree returns the tree of a bucket, building it if needed. The DB has
+// to be locked.
+func (db *DB) getTree(bucket string) (t *tree, err error) {
+	db.treesMu.Lock()
+	defer db.treesMu.Unlock()
+	if t = db.trees[bucket]; t != nil {
+		return
+	}
+	t = new(tree)
+	err = db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' does not exist", bucket)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			t.set(string(k), v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if db.trees == nil {
+		db.trees = make(map[string]*tree)
+	}
+	db.trees[bucket] = t
+	return
+}
+
+// treeSet updates the tree of a bucket, if it was built. The DB has to be
+// locked for writing.
+func (db *DB) treeSet(bucket, key string, value []byte) {
+	db.treesMu.Lock()
+	defer db.treesMu.Unlock()
+	if t := db.trees[bucket]; t != nil {
+		t.set(key, value)
+	}
+}
+
+// treeDelete removes a key from the tree of a bucket, if it was built.
+func (db *DB) treeDelete(bucket, key string) {
+	db.treesMu.Lock()
+	defer db.treesMu.Unlock()
+	if t := db.trees[bucket]; t != nil {
+		t.delete(key)
+	}
+}
@@ -0,0 +1,240 @@
+package depot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Every stored value carries the version of the write that made it, so that
+// two peers with different values for a key can agree on which one wins.
+// A version is a hybrid logical clock (HLC) and the node that wrote it.
+//
+// A stored value is a header byte, the clock, the length and name of the
+// node, and then the JSON of the value. The header byte is 1 for a value and
+// 0 for a tombstone, which JSON never starts with, so that values stored
+// before they were versioned are read as JSON with the zero version.
+
+const (
+	headerTombstone = 0x00
+	headerValue     = 0x01
+	// versionSize is the size of the header and clock
+	versionSize = 1 + 8 + 1
+)
+
+// ErrNodeName is returned for a node name longer than 255 bytes.
+var ErrNodeName = errors.New("depot: node name is too long")
+
+// HLC is a hybrid logical clock, with milliseconds since the epoch in the
+// top 48 bits and a counter for events in the same millisecond below.
+type HLC uint64
+
+// Time returns the physical time of the clock.
+func (c HLC) Time() time.Time {
+	ms := int64(c >> 16)
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func physical(t time.Time) HLC {
+	return HLC(t.UnixNano()/int64(time.Millisecond)) << 16
+}
+
+// Version tells which write made a value.
+type Version struct {
+	Clock HLC
+	Node  string
+}
+
+// Less orders versions by the clock and then by the node.
+func (v Version) Less(o Version) bool {
+	if v.Clock != o.Clock {
+		return v.Clock < o.Clock
+	}
+	return v.Node < o.Node
+}
+
+// Versioned is a stored value with its version. Value is the JSON of the
+// value and is empty when Deleted is set.
+type Versioned struct {
+	Version
+	Value   []byte
+	Deleted bool
+}
+
+// MergeFunc decides the value of a key that two peers have with different
+// versions. It returns local or remote to keep one of them, or a new value,
+// which is written as a new version by this node. A returned value that is
+// the same as one of them keeps its version.
+type MergeFunc func(key string, local, remote Versioned) Versioned
+
+// LastWriterWins is the MergeFunc of every bucket unless it is changed
+// with SetMerge. It keeps the later version, and for equal versions a
+// delete and then the larger JSON, so that every peer picks the same one.
+func LastWriterWins(key string, local, remote Versioned) Versioned {
+	switch {
+	case local.Less(remote.Version):
+		return remote
+	case remote.Less(local.Version):
+		return local
+	case local.Deleted != remote.Deleted:
+		if local.Deleted {
+			return local
+		}
+		return remote
+	case bytes.Compare(remote.Value, local.Value) > 0:
+		return remote
+	}
+	return local
+}
+
+// SetMerge sets the MergeFunc of the bucket, which is used when sync finds
+// a key with different values. A nil MergeFunc is LastWriterWins.
+func (db *DB) SetMerge(bucket string, merge MergeFunc) {
+	db.Lock()
+	defer db.Unlock()
+	if db.merges == nil {
+		db.merges = make(map[string]MergeFunc)
+	}
+	db.merges[bucket] = merge
+}
+
+// merge returns the stored value that wins between two stored values. The
+// DB has to be locked.
+func (db *DB) merge(bucket, key string, local, remote []byte) []byte {
+	if sameContent(local, remote) {
+		return local
+	}
+	merge := db.merges[bucket]
+	if merge == nil {
+		merge = LastWriterWins
+	}
+	l, r := decodeVersioned(local), decodeVersioned(remote)
+	v := merge(key, l, r)
+	// a value that one of them already has keeps its version, so that
+	// merging again does not make another one
+	switch {
+	case v.Deleted == l.Deleted && bytes.Equal(v.Value, l.Value):
+		return local
+	case v.Deleted == r.Deleted && bytes.Equal(v.Value, r.Value):
+		return remote
+	}
+	// a new value is later than both
+	db.clock.observe(l.Clock)
+	db.clock.observe(r.Clock)
+	v.Version = Version{db.clock.now(), db.node}
+	return encodeVersioned(v)
+}
+
+func encodeVersioned(v Versioned) []byte {
+	b := make([]byte, versionSize, versionSize+len(v.Node)+len(v.Value))
+	b[0] = headerValue
+	if v.Deleted {
+		b[0] = headerTombstone
+	}
+	binary.BigEndian.PutUint64(b[1:], uint64(v.Clock))
+	b[9] = byte(len(v.Node))
+	b = append(b, v.Node...)
+	if !v.Deleted {
+		b = append(b, v.Value...)
+	}
+	return b
+}
+
+// decodeVersioned reads a stored value, where anything that is not
+// versioned is JSON with the zero version.
+func decodeVersioned(b []byte) (v Versioned) {
+	if len(b) < versionSize || (b[0] != headerValue && b[0] != headerTombstone) {
+		v.Value = b
+		return
+	}
+	n := int(b[9])
+	if len(b) < versionSize+n {
+		v.Value = b
+		return
+	}
+	v.Deleted = b[0] == headerTombstone
+	v.Clock = HLC(binary.BigEndian.Uint64(b[1:]))
+	v.Node = string(b[versionSize : versionSize+n])
+	if !v.Deleted {
+		v.Value = b[versionSize+n:]
+	}
+	return
+}
+
+// content returns the part of a stored value that is compared by sync,
+// which leaves out the version, so that the same value written by two
+// nodes is not a conflict.
+func content(stored []byte) []byte {
+	v := decodeVersioned(stored)
+	if v.Deleted {
+		return []byte{headerTombstone}
+	}
+	return v.Value
+}
+
+// sameContent tells if two stored values only differ in their versions.
+func sameContent(a, b []byte) bool {
+	return bytes.Equal(content(a), content(b))
+}
+
+// clock is the hybrid logical clock of a node.
+type clock struct {
+	mu   sync.Mutex
+	last HLC
+}
+
+// MaxClockOffset is how far ahead of the local time the clock of another
+// node can be. Values with later clocks are not stored, since they would
+// move the clock of every node that syncs them.
+const MaxClockOffset = time.Minute
+
+// now returns a clock that is later than every clock before it.
+func (c *clock) now() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p := physical(time.Now()); p > c.last {
+		c.last = p
+	} else if c.last < ^HLC(0) {
+		c.last++
+	}
+	return c.last
+}
+
+// observe moves the clock past a clock from another node, unless it is
+// more than MaxClockOffset ahead.
+func (c *clock) observe(other HLC) (ok bool) {
+	if other > physical(time.Now().Add(MaxClockOffset)) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if other > c.last {
+		c.last = other
+	}
+	return true
+}
+
+// Option is an option of New.
+type Option func(*DB) error
+
+// WithNode sets the name of the node in the versions that it writes. The
+// default is a random name for every New.
+func WithNode(node string) Option {
+	return func(db *DB) error {
+		if len(node) > 255 {
+			return ErrNodeName
+		}
+		db.node = node
+		return nil
+	}
+}
+
+func randomNode() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,159 @@
+package depot
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// A watch reads the log of the bucket, so a consumer that is slow only
+// falls behind in the log instead of holding up the writes or missing
+// events, and one that restarts can go on from the last sequence number
+// that it saw.
+
+// watchBatch is the number of changes that a watch reads at once.
+const watchBatch = 100
+
+// EventType tells what happened to a key.
+type EventType int
+
+const (
+	// EventSet is a key that was set
+	EventSet EventType = iota
+	// EventDelete is a key that was deleted
+	EventDelete
+)
+
+func (t EventType) String() string {
+	if t == EventDelete {
+		return "delete"
+	}
+	return "set"
+}
+
+// Event is a change to a key that is being watched. The last event before
+// the channel closes has Err set if the watch could not go on.
+type Event struct {
+	Type EventType
+	Seq  uint64
+	Key  string
+	// Value is the JSON of the value, which is empty for a delete
+	Value   []byte
+	Version Version
+	Err     error
+}
+
+// Decode unmarshals the value of the event.
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Value, v)
+}
+
+func changeEvent(c Change) Event {
+	v := c.Versioned()
+	e := Event{Seq: c.Seq, Key: c.Key, Value: v.Value, Version: v.Version}
+	if v.Deleted {
+		e.Type = EventDelete
+	}
+	return e
+}
+
+type watchOptions struct {
+	since    uint64
+	hasSince bool
+}
+
+// WatchOption is an option of Watch.
+type WatchOption func(*watchOptions)
+
+// WithSince makes a watch start after the sequence number, instead of
+// after the last change, to resume where a consumer stopped.
+func WithSince(seq uint64) WatchOption {
+	return func(o *watchOptions) {
+		o.since = seq
+		o.hasSince = true
+	}
+}
+
+// Watch returns the events of the keys of the bucket that start with the
+// prefix, including the ones that sync stores. The channel is closed when
+// ctx is done. It returns ErrTruncated when the changes to resume from are
+// no longer in the log.
+func (db *DB) Watch(ctx context.Context, bucket, prefix string, opts ...WatchOption) (events <-chan Event, err error) {
+	var o watchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	since := o.since
+	if !o.hasSince {
+		if since, err = db.Seq(bucket); err != nil {
+			return
+		}
+	}
+	if _, err = db.Changes(bucket, since, 1); err != nil {
+		return
+	}
+	ch := make(chan Event)
+	go db.watch(ctx, bucket, prefix, since, ch)
+	return ch, nil
+}
+
+func (db *DB) watch(ctx context.Context, bucket, prefix string, since uint64, ch chan<- Event) {
+	defer close(ch)
+	for {
+		// the wait starts before the read, so no write is missed between
+		wake := db.waitChan(bucket)
+		changes, err := db.Changes(bucket, since, watchBatch)
+		if err != nil {
+			select {
+			case ch <- Event{Seq: since, Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		for _, c := range changes {
+			since = c.Seq
+			if !strings.HasPrefix(c.Key, prefix) {
+				continue
+			}
+			select {
+			case ch <- changeEvent(c):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(changes) == watchBatch {
+			continue
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitChan returns a channel that is closed at the next write to the
+// bucket.
+func (db *DB) waitChan(bucket string) <-chan struct{} {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if db.wakes == nil {
+		db.wakes = make(map[string]chan struct{})
+	}
+	c, ok := db.wakes[bucket]
+	if !ok {
+		c = make(chan struct{})
+		db.wakes[bucket] = c
+	}
+	return c
+}
+
+// wake tells the watches of the bucket that there are changes.
+func (db *DB) wake(bucket string) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if c, ok := db.wakes[bucket]; ok {
+		close(c)
+		delete(db.wakes, bucket)
+	}
+}
@@ -0,0 +1,411 @@
+package eml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	net_mail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+)
+
+// unknownDomain is used for public keys that are not in the address book.
+const unknownDomain = "maildepot.invalid"
+
+// Payload is the content of an email, which is stored as JSON in the
+// payload of a mail.Message.
+type Payload struct {
+	Subject     string              `json:"subject,omitempty"`
+	From        string              `json:"from,omitempty"`
+	Date        time.Time           `json:"date"`
+	MessageID   string              `json:"message_id,omitempty"`
+	InReplyTo   string              `json:"in_reply_to,omitempty"`
+	Headers     map[string][]string `json:"headers,omitempty"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty"`
+}
+
+// Attachment is a file attached to an email.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// AddressBook maps email addresses to public keys.
+type AddressBook map[string]string
+
+// Lookup returns the public key of an email address.
+func (ab AddressBook) Lookup(address string) (publicKey string, ok bool) {
+	publicKey, ok = ab[strings.ToLower(address)]
+	return
+}
+
+// Address returns the email address of a public key. Public keys that are
+// not in the address book get an address that can be turned back into
+// the public key.
+func (ab AddressBook) Address(publicKey string) string {
+	for address, key := range ab {
+		if key == publicKey {
+			return address
+		}
+	}
+	return fmt.Sprintf("%q@%s", publicKey, unknownDomain)
+}
+
+// resolve returns the public key for an address, including the ones
+// made by Address for unknown keys.
+func (ab AddressBook) resolve(address string) (publicKey string, err error) {
+	if publicKey, ok := ab.Lookup(address); ok {
+		return publicKey, nil
+	}
+	if strings.HasSuffix(address, "@"+unknownDomain) {
+		publicKey = strings.TrimSuffix(address, "@"+unknownDomain)
+		if _, err = keypair.NewFromPublic(publicKey); err == nil {
+			return
+		}
+	}
+	err = fmt.Errorf("no public key for '%s'", address)
+	return
+}
+
+// headers that are part of the Payload or the mail.Header
+var knownHeaders = map[string]bool{
+	"Subject": true, "From": true, "To": true, "Cc": true, "Bcc": true,
+	"Date": true, "Message-Id": true, "In-Reply-To": true,
+	"Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// Parse will parse an RFC 5322 email into a payload and the recipients.
+// Addresses that are not in the address book are left out of the
+// recipients.
+func Parse(r io.Reader, book AddressBook) (p Payload, h mail.Header, err error) {
+	msg, err := net_mail.ReadMessage(r)
+	if err != nil {
+		return
+	}
+	dec := new(mime.WordDecoder)
+	p.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return
+	}
+	p.From = msg.Header.Get("From")
+	p.MessageID = msg.Header.Get("Message-Id")
+	p.InReplyTo = msg.Header.Get("In-Reply-To")
+	if date, err2 := msg.Header.Date(); err2 == nil {
+		p.Date = date
+	}
+	for key, values := range msg.Header {
+		if !knownHeaders[textproto.CanonicalMIMEHeaderKey(key)] {
+			if p.Headers == nil {
+				p.Headers = make(map[string][]string)
+			}
+			p.Headers[key] = values
+		}
+	}
+
+	for _, field := range []struct {
+		name string
+		keys *[]string
+	}{{"To", &h.To}, {"Cc", &h.Cc}, {"Bcc", &h.Bcc}} {
+		if msg.Header.Get(field.name) == "" {
+			continue
+		}
+		var addresses []*net_mail.Address
+		addresses, err = msg.Header.AddressList(field.name)
+		if err != nil {
+			err = errors.Wrap(err, field.name)
+			return
+		}
+		for _, address := range addresses {
+			// others may be copied that are not in the address book
+			publicKey, err2 := book.resolve(address.Address)
+			if err2 != nil {
+				continue
+			}
+			*field.keys = append(*field.keys, publicKey)
+		}
+	}
+
+	err = parsePart(&p, textproto.MIMEHeader(msg.Header), msg.Body)
+	return
+}
+
+func parsePart(p *Payload, header textproto.MIMEHeader, body io.Reader) (err error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			var part *multipart.Part
+			part, err = mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return
+			}
+			err = parsePart(p, part.Header, part)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	switch {
+	case disposition != "attachment" && mediaType == "text/plain" && p.Text == "":
+		p.Text = string(data)
+	case disposition != "attachment" && mediaType == "text/html" && p.HTML == "":
+		p.HTML = string(data)
+	default:
+		if decoded, err2 := new(mime.WordDecoder).DecodeHeader(filename); err2 == nil {
+			filename = decoded
+		}
+		p.Attachments = append(p.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Data:        data,
+		})
+	}
+	return
+}
+
+// newlineStripper removes line breaks from base64 bodies.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (ns *newlineStripper) Read(b []byte) (n int, err error) {
+	n, err = ns.r.Read(b)
+	j := 0
+	for _, c := range b[:n] {
+		if c != '\r' && c != '\n' {
+			b[j] = c
+			j++
+		}
+	}
+	return j, err
+}
+
+// Import will read an RFC 5322 email and generate the messages for it,
+// one for the To and Cc recipients and one for each Bcc recipient.
+func Import(world keypair.KeyPair, sender keypair.KeyPair, book AddressBook, r io.Reader, opts ...mail.Option) (msgs []mail.Message, err error) {
+	p, h, err := Parse(r, book)
+	if err != nil {
+		return
+	}
+	if len(h.To)+len(h.Cc)+len(h.Bcc) == 0 {
+		err = errors.New("no recipients in the address book")
+		return
+	}
+	if p.Date.IsZero() {
+		p.Date = time.Now().UTC()
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	return mail.NewWithHeader(world, sender, h, payload, opts...)
+}
+
+// Export will render an opened message as an RFC 5322 email. Messages
+// that were not imported are exported as plain text.
+func Export(om mail.OpenMessage, book AddressBook) (raw []byte, err error) {
+	var p Payload
+	if json.Unmarshal(om.MessageBytes, &p) != nil {
+		p = Payload{Text: string(om.MessageBytes)}
+	}
+
+	var buf bytes.Buffer
+	// the payload is from the sender, so a line break can not add headers
+	writeHeader := func(key, value string) {
+		if value != "" && !strings.ContainsAny(value, "\r\n") {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+		}
+	}
+	addresses := func(keys []string) string {
+		list := make([]string, len(keys))
+		for i, key := range keys {
+			list[i] = book.Address(key)
+		}
+		return strings.Join(list, ", ")
+	}
+
+	from := book.Address(om.Sender)
+	if p.From != "" {
+		if address, err2 := net_mail.ParseAddress(p.From); err2 == nil && address.Address == from {
+			from = p.From
+		}
+	}
+	writeHeader("From", from)
+	writeHeader("To", addresses(om.Header.To))
+	writeHeader("Cc", addresses(om.Header.Cc))
+	writeHeader("Bcc", addresses(om.Header.Bcc))
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", p.Subject))
+	if p.Date.IsZero() {
+		p.Date = time.Now()
+	}
+	writeHeader("Date", p.Date.Format(time.RFC1123Z))
+	writeHeader("Message-Id", p.MessageID)
+	writeHeader("In-Reply-To", p.InReplyTo)
+	// the headers that are written here can not be replaced
+	keys := make([]string, 0, len(p.Headers))
+	for key := range p.Headers {
+		if validHeaderKey(key) && !knownHeaders[textproto.CanonicalMIMEHeaderKey(key)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range p.Headers[key] {
+			writeHeader(key, value)
+		}
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	mw := multipart.NewWriter(&buf)
+	writeHeader("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	buf.WriteString("\r\n")
+
+	err = writeBody(mw, p)
+	if err != nil {
+		return
+	}
+	for _, a := range p.Attachments {
+		var w io.Writer
+		w, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachmentType(a.ContentType)},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+		})
+		if err != nil {
+			return
+		}
+		err = writeBase64(w, a.Data)
+		if err != nil {
+			return
+		}
+	}
+	err = mw.Close()
+	raw = buf.Bytes()
+	return
+}
+
+// attachmentType returns the content type of an attachment as it is
+// written again by mime, so the sender can not add headers or parts.
+func attachmentType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		if formatted := mime.FormatMediaType(mediaType, params); formatted != "" {
+			return formatted
+		}
+	}
+	return "application/octet-stream"
+}
+
+// validHeaderKey tells if the key is a header field name of RFC 5322.
+func validHeaderKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeBody writes the text and html, as alternatives if there are both.
+func writeBody(mw *multipart.Writer, p Payload) (err error) {
+	if p.HTML == "" {
+		return writeText(mw, "text/plain", p.Text)
+	}
+	if p.Text == "" {
+		return writeText(mw, "text/html", p.HTML)
+	}
+
+	var buf bytes.Buffer
+	alternative := multipart.NewWriter(&buf)
+	if err = writeText(alternative, "text/plain", p.Text); err != nil {
+		return
+	}
+	if err = writeText(alternative, "text/html", p.HTML); err != nil {
+		return
+	}
+	if err = alternative.Close(); err != nil {
+		return
+	}
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alternative.Boundary()})},
+	})
+	if err != nil {
+		return
+	}
+	_, err = w.Write(buf.Bytes())
+	return
+}
+
+func writeText(mw *multipart.Writer, mediaType string, text string) (err error) {
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"})},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return
+	}
+	qw := quotedprintable.NewWriter(w)
+	if _, err = qw.Write([]byte(text)); err != nil {
+		return
+	}
+	return qw.Close()
+}
+
+// writeBase64 writes base64 in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) (err error) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err = io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(w, encoded+"\r\n")
+	return
+}
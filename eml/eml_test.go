@@ -0,0 +1,161 @@
+package eml
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	net_mail "net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+const testEmail = "From: Bob <bob@example.com>\r\n" +
+	"To: Jane <jane@example.com>\r\n" +
+	"Bcc: jeff@example.com\r\n" +
+	"Subject: =?utf-8?q?h=C3=A9llo?=\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+	"Message-Id: <1@example.com>\r\n" +
+	"X-Mailer: test\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"hello, w=C3=B6rld\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>hello, world</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"AwQ=\r\n" +
+	"--outer--\r\n"
+
+func TestImportExport(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	jeff, _ := keypair.New()
+	book := AddressBook{
+		"bob@example.com":  bob.Public,
+		"jane@example.com": jane.Public,
+		"jeff@example.com": jeff.Public,
+	}
+
+	msgs, err := Import(world, bob, book, strings.NewReader(testEmail))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+
+	openMsg, err := msgs[0].Open(world, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	raw, err := Export(openMsg, book)
+	assert.Nil(t, err)
+
+	p, h, err := Parse(bytes.NewReader(raw), book)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{jane.Public}, h.To)
+	assert.Empty(t, h.Bcc)
+	assert.Equal(t, "héllo", p.Subject)
+	assert.Equal(t, "Bob <bob@example.com>", p.From)
+	assert.Equal(t, "<1@example.com>", p.MessageID)
+	assert.Equal(t, []string{"test"}, p.Headers["X-Mailer"])
+	assert.Equal(t, "hello, wörld", strings.TrimSpace(p.Text))
+	assert.Equal(t, "<p>hello, world</p>", strings.TrimSpace(p.HTML))
+	assert.Equal(t, 1, len(p.Attachments))
+	assert.Equal(t, "data.bin", p.Attachments[0].Filename)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4}, p.Attachments[0].Data)
+	assert.Equal(t, 2006, p.Date.Year())
+
+	// jeff only sees himself in the Bcc
+	openMsg, err = msgs[1].Open(world, []keypair.KeyPair{jeff})
+	assert.Nil(t, err)
+	raw, err = Export(openMsg, book)
+	assert.Nil(t, err)
+	_, h, err = Parse(bytes.NewReader(raw), book)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{jeff.Public}, h.Bcc)
+
+	// unknown keys get an address that maps back to the key
+	stranger, _ := keypair.New()
+	msg, _ := mail.New(world, stranger, []string{jane.Public}, []byte("plain text"))
+	openMsg, _ = msg.Open(world, []keypair.KeyPair{jane})
+	raw, err = Export(openMsg, book)
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), unknownDomain)
+	address, err := net_mail.ParseAddress(book.Address(stranger.Public))
+	assert.Nil(t, err)
+	publicKey, err := book.resolve(address.Address)
+	assert.Nil(t, err)
+	assert.Equal(t, stranger.Public, publicKey)
+
+	_, err = Import(world, bob, book, strings.NewReader("To: nobody@example.com\r\n\r\nhi"))
+	assert.NotNil(t, err)
+
+	// the sender can not add or replace headers
+	payload, _ := json.Marshal(Payload{
+		Text:      "hi",
+		MessageID: "<2@example.com>\r\nBcc: eve@example.com",
+		Attachments: []Attachment{
+			{Filename: "a.txt", ContentType: "text/plain\r\nX-Part: 1", Data: []byte("a")},
+			{Filename: "b.txt", ContentType: "text/plain; charset=utf-8", Data: []byte("b")},
+		},
+		Headers: map[string][]string{
+			"Content-Type": {"text/plain"},
+			"X-B":          {"b"},
+			"X-A":          {"a\r\nX-Injected: 1"},
+			"X-C: d":       {"c"},
+		},
+	})
+	msg, _ = mail.New(world, stranger, []string{jane.Public}, payload)
+	openMsg, _ = msg.Open(world, []keypair.KeyPair{jane})
+	raw, err = Export(openMsg, book)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(raw), "eve@example.com")
+	assert.NotContains(t, string(raw), "X-Injected")
+	assert.NotContains(t, string(raw), "X-Part")
+	assert.Contains(t, string(raw), "Content-Type: application/octet-stream\r\n")
+	assert.Contains(t, string(raw), "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.NotContains(t, string(raw), "X-C")
+	assert.Equal(t, 1, strings.Count(string(raw), "Content-Type: multipart/mixed"))
+	assert.NotContains(t, string(raw), "Content-Type: text/plain\r\nX-B")
+	assert.Contains(t, string(raw), "X-B: b\r\n")
+}
+
+func TestMbox(t *testing.T) {
+	var buf bytes.Buffer
+	mw := NewMboxWriter(&buf)
+	date := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	assert.Nil(t, mw.Write("bob@example.com", date, []byte("Subject: hi\r\n\r\nFrom here\r\n>From there\r\n")))
+	assert.Nil(t, mw.Write("", date, []byte("Subject: again\r\n\r\nbye\r\n")))
+	assert.Equal(t, "From bob@example.com Mon Jan  2 15:04:05 2006\n"+
+		"Subject: hi\n\n>From here\n>>From there\n\n"+
+		"From MAILER-DAEMON Mon Jan  2 15:04:05 2006\n"+
+		"Subject: again\n\nbye\n\n", buf.String())
+}
+
+func TestMaildir(t *testing.T) {
+	md := Maildir(filepath.Join(t.TempDir(), "Mail"))
+	name, err := md.Deliver([]byte(testEmail))
+	assert.Nil(t, err)
+	b, err := ioutil.ReadFile(filepath.Join(string(md), "new", name))
+	assert.Nil(t, err)
+	assert.Equal(t, testEmail, string(b))
+	files, _ := ioutil.ReadDir(filepath.Join(string(md), "tmp"))
+	assert.Empty(t, files)
+}
@@ -0,0 +1,54 @@
+package eml
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Maildir delivers emails into a Maildir directory.
+type Maildir string
+
+// Init creates the tmp, new and cur directories.
+func (md Maildir) Init() (err error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err = os.MkdirAll(filepath.Join(string(md), sub), 0700)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Deliver will write the email into tmp and then move it into new, so
+// that readers never see a partial email. It returns the unique name.
+func (md Maildir) Deliver(raw []byte) (name string, err error) {
+	err = md.Init()
+	if err != nil {
+		return
+	}
+	random := make([]byte, 8)
+	if _, err = crypto_rand.Read(random); err != nil {
+		return
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	name = fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), hex.EncodeToString(random), hostname)
+
+	tmp := filepath.Join(string(md), "tmp", name)
+	err = ioutil.WriteFile(tmp, raw, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, filepath.Join(string(md), "new", name))
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package eml
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MboxWriter appends emails to an mbox file in the mboxrd format.
+type MboxWriter struct {
+	w io.Writer
+}
+
+// NewMboxWriter returns a writer that appends emails to w.
+func NewMboxWriter(w io.Writer) *MboxWriter {
+	return &MboxWriter{w: w}
+}
+
+// Write will append an email with the envelope sender and date.
+func (mw *MboxWriter) Write(from string, date time.Time, raw []byte) (err error) {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	bw := bufio.NewWriter(mw.w)
+	fmt.Fprintf(bw, "From %s %s\n", from, date.UTC().Format(time.ANSIC))
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 64*1024), len(raw)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		// mboxrd quotes any line that looks like a From line
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			bw.WriteByte('>')
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
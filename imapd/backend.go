@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+const delimiter = "/"
+
+// imapBackend serves the mailboxes of a single user from the store.
+type imapBackend struct {
+	store    *store
+	username string
+	password string
+}
+
+func (be *imapBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if username != be.username || password != be.password {
+		return nil, errors.New("bad username or password")
+	}
+	return &imapUser{be: be}, nil
+}
+
+type imapUser struct {
+	be *imapBackend
+}
+
+func (u *imapUser) Username() string {
+	return u.be.username
+}
+
+func (u *imapUser) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
+	names, err := u.be.store.mailboxNames()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		state, err2 := u.be.store.mailbox(name)
+		if err2 != nil || (subscribed && !state.Subscribed) {
+			continue
+		}
+		mailboxes = append(mailboxes, &imapMailbox{name: name, store: u.be.store})
+	}
+	return
+}
+
+func (u *imapUser) GetMailbox(name string) (mailbox backend.Mailbox, err error) {
+	if _, err = u.be.store.mailbox(name); err != nil {
+		err = backend.ErrNoSuchMailbox
+		return
+	}
+	mailbox = &imapMailbox{name: name, store: u.be.store}
+	return
+}
+
+func (u *imapUser) CreateMailbox(name string) error {
+	if _, err := u.be.store.mailbox(name); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+	return u.be.store.createMailbox(name)
+}
+
+func (u *imapUser) DeleteMailbox(name string) error {
+	if name == inbox {
+		return errors.New("cannot delete INBOX")
+	}
+	if _, err := u.be.store.mailbox(name); err != nil {
+		return backend.ErrNoSuchMailbox
+	}
+	return u.be.store.deleteMailbox(name)
+}
+
+func (u *imapUser) RenameMailbox(existingName, newName string) error {
+	if _, err := u.be.store.mailbox(existingName); err != nil {
+		return backend.ErrNoSuchMailbox
+	}
+	if _, err := u.be.store.mailbox(newName); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+	return u.be.store.renameMailbox(existingName, newName)
+}
+
+func (u *imapUser) Logout() error {
+	return nil
+}
+
+type imapMailbox struct {
+	name  string
+	store *store
+}
+
+func (mbox *imapMailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *imapMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: delimiter, Name: mbox.name}, nil
+}
+
+func (mbox *imapMailbox) Status(items []imap.StatusItem) (status *imap.MailboxStatus, err error) {
+	state, err := mbox.store.mailbox(mbox.name)
+	if err != nil {
+		return
+	}
+	msgs, err := mbox.store.messages(mbox.name)
+	if err != nil {
+		return
+	}
+
+	status = imap.NewMailboxStatus(mbox.name, items)
+	status.PermanentFlags = []string{"\\*"}
+	flags := make(map[string]bool)
+	var unseen uint32
+	for i, msg := range msgs {
+		for _, flag := range msg.Flags {
+			if !flags[flag] {
+				flags[flag] = true
+				status.Flags = append(status.Flags, flag)
+			}
+		}
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(msgs))
+		case imap.StatusUidNext:
+			status.UidNext = state.UIDNext
+		case imap.StatusUidValidity:
+			status.UidValidity = state.UIDValidity
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return
+}
+
+func (mbox *imapMailbox) SetSubscribed(subscribed bool) error {
+	return mbox.store.setSubscribed(mbox.name, subscribed)
+}
+
+func (mbox *imapMailbox) Check() error {
+	return nil
+}
+
+// each calls fn for every message in the set, with its sequence number.
+func (mbox *imapMailbox) each(uid bool, seqSet *imap.SeqSet, fn func(seqNum uint32, msg storedMessage) error) (err error) {
+	msgs, err := mbox.store.messages(mbox.name)
+	if err != nil {
+		return
+	}
+	for i, msg := range msgs {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = msg.UID
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+		if err = fn(seqNum, msg); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (mbox *imapMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	return mbox.each(uid, seqSet, func(seqNum uint32, msg storedMessage) error {
+		fetched, err := fetch(seqNum, msg, items)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", msg.UID, err)
+		}
+		ch <- fetched
+		return nil
+	})
+}
+
+func (mbox *imapMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) (ids []uint32, err error) {
+	msgs, err := mbox.store.messages(mbox.name)
+	if err != nil {
+		return
+	}
+	for i, msg := range msgs {
+		seqNum := uint32(i + 1)
+		e, err2 := message.Read(bytes.NewReader(msg.Body))
+		if err2 != nil && !message.IsUnknownCharset(err2) {
+			continue
+		}
+		ok, err2 := backendutil.Match(e, seqNum, msg.UID, msg.Date, msg.Flags, criteria)
+		if err2 != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.UID)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return
+}
+
+func (mbox *imapMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) (err error) {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+	_, err = mbox.store.add(mbox.name, storedMessage{Date: date, Flags: flags, Body: b})
+	return
+}
+
+func (mbox *imapMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.each(uid, seqSet, func(seqNum uint32, msg storedMessage) error {
+		msg.Flags = backendutil.UpdateFlags(msg.Flags, op, flags)
+		return mbox.store.update(mbox.name, msg)
+	})
+}
+
+func (mbox *imapMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	if _, err := mbox.store.mailbox(destName); err != nil {
+		return backend.ErrNoSuchMailbox
+	}
+	return mbox.each(uid, seqSet, func(seqNum uint32, msg storedMessage) (err error) {
+		_, err = mbox.store.add(destName, msg)
+		return
+	})
+}
+
+func (mbox *imapMailbox) Expunge() error {
+	return mbox.each(false, allMessages(), func(seqNum uint32, msg storedMessage) error {
+		if !hasFlag(msg.Flags, imap.DeletedFlag) {
+			return nil
+		}
+		return mbox.store.remove(mbox.name, msg.UID)
+	})
+}
+
+func allMessages() *imap.SeqSet {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+	return seqSet
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch returns the requested items of a message.
+func fetch(seqNum uint32, msg storedMessage, items []imap.FetchItem) (fetched *imap.Message, err error) {
+	headerAndBody := func() (textproto.Header, *bufio.Reader, error) {
+		body := bufio.NewReader(bytes.NewReader(msg.Body))
+		hdr, err := textproto.ReadHeader(body)
+		return hdr, body, err
+	}
+
+	fetched = imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, _ := headerAndBody()
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, _ := headerAndBody()
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = msg.Flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.Date
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(msg.Body))
+		case imap.FetchUid:
+			fetched.Uid = msg.UID
+		default:
+			section, err2 := imap.ParseBodySectionName(item)
+			if err2 != nil {
+				break
+			}
+			hdr, body, err2 := headerAndBody()
+			if err2 != nil {
+				return nil, err2
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	crypto_rand "crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/eml"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/schollz/maildepot/timeauthority/authtime"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/sign"
+)
+
+type fakeSource []mail.Message
+
+func (fs fakeSource) Messages() ([]mail.Message, error) {
+	return fs, nil
+}
+
+func TestIMAP(t *testing.T) {
+	os.Remove("imapd.db")
+	defer os.Remove("imapd.db")
+	db, err := depot.New("imapd.db")
+	assert.Nil(t, err)
+	defer db.Close()
+	st, err := newStore(db)
+	assert.Nil(t, err)
+
+	world, _ := keypair.New()
+	sender, _ := keypair.New()
+	jane, _ := keypair.New()
+	jeff, _ := keypair.New()
+	book := eml.AddressBook{
+		"jane@example.com": jane.Public,
+		"jeff@example.com": jeff.Public,
+	}
+	var msgs fakeSource
+	for _, to := range []string{jane.Public, jeff.Public, jane.Public} {
+		m, err := mail.NewWithHeader(world, sender, mail.Header{To: []string{to}}, []byte("hello, world"))
+		assert.Nil(t, err)
+		msgs = append(msgs, m...)
+	}
+
+	s := &syncer{store: st, source: msgs, world: world, keys: []keypair.KeyPair{jane}, book: book}
+	added, err := s.sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, added)
+	// nothing new the second time
+	added, err = s.sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, added)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := server.New(&imapBackend{store: st, username: "jane", password: "secret"})
+	srv.AllowInsecureAuth = true
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c, err := client.Dial(l.Addr().String())
+	assert.Nil(t, err)
+	defer c.Logout()
+	assert.NotNil(t, c.Login("jane", "wrong"))
+	assert.Nil(t, c.Login("jane", "secret"))
+
+	status, err := c.Select(inbox, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), status.Messages)
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 2)
+	section := &imap.BodySectionName{}
+	fetched := make(chan *imap.Message, 2)
+	assert.Nil(t, c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, section.FetchItem()}, fetched))
+	n := 0
+	for msg := range fetched {
+		n++
+		assert.Equal(t, "jane@example.com", msg.Envelope.To[0].Address())
+		body, err := ioutil.ReadAll(msg.GetBody(section))
+		assert.Nil(t, err)
+		assert.Contains(t, string(body), "hello, world")
+	}
+	assert.Equal(t, 2, n)
+
+	// flags and UIDs persist in the store
+	assert.Nil(t, c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag, imap.DeletedFlag}, nil))
+	assert.Nil(t, c.Create("Archive"))
+	assert.Nil(t, c.Copy(seqSet, "Archive"))
+	assert.Nil(t, c.Expunge(nil))
+	stored, err := st.messages(inbox)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(stored))
+	stored, err = st.messages("Archive")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(stored))
+	assert.Contains(t, stored[0].Flags, imap.SeenFlag)
+
+	// a mailbox that is created again gets a new UIDVALIDITY
+	before, _ := st.mailbox("Archive")
+	assert.Nil(t, st.deleteMailbox("Archive"))
+	assert.Nil(t, st.createMailbox("Archive"))
+	after, _ := st.mailbox("Archive")
+	assert.True(t, after.UIDValidity > before.UIDValidity)
+	names, err := st.mailboxNames()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{inbox, "Archive"}, names)
+
+	// the internal date is the time from the time authority
+	_, signKey, _ := sign.GenerateKey(crypto_rand.Reader)
+	sent := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	timed, err := mail.New(world, sender, []string{jane.Public}, []byte("hello"), mail.WithExpiry(authtime.Sign(sent, signKey), time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, sent.Equal(internalDate(timed)))
+
+	// a copy with other recipients does not hide the message
+	real, _ := mail.New(world, sender, []string{jane.Public}, []byte("hello again"))
+	copied := real
+	copied.Recipients = msgs[1].Recipients
+	s.source = fakeSource{copied}
+	added, err = s.sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, added)
+	s.source = fakeSource{copied, real}
+	added, err = s.sync(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+}
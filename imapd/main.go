@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap/server"
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/eml"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+)
+
+func main() {
+	var listen, dbName, relayURL, username, password, keysFile, worldPassphrase, bookFile, authority string
+	var interval time.Duration
+	flag.StringVar(&listen, "listen", "127.0.0.1:1143", "address to listen on")
+	flag.StringVar(&dbName, "db", "imapd.db", "depot database for the mailboxes")
+	flag.StringVar(&relayURL, "relay", "http://localhost:8080", "relay to sync from")
+	flag.StringVar(&username, "user", "me", "IMAP username")
+	flag.StringVar(&password, "password", "", "IMAP password")
+	flag.StringVar(&keysFile, "keys", "keys.json", "JSON file with the key pairs of the user")
+	flag.StringVar(&worldPassphrase, "world", "world1", "passphrase of the world key")
+	flag.StringVar(&bookFile, "addresses", "addresses.json", "JSON file mapping email addresses to public keys")
+	flag.StringVar(&authority, "authority", "", "public key of the time authority")
+	flag.DurationVar(&interval, "interval", time.Minute, "time between syncs")
+	flag.Parse()
+	if password == "" {
+		log.Fatal("need -password")
+	}
+
+	world, err := keypair.NewDeterministic(worldPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var keys []keypair.KeyPair
+	if err = readJSON(keysFile, &keys); err != nil {
+		log.Fatal(err)
+	}
+	for i := range keys {
+		keys[i], err = keypair.New(keys[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	book := eml.AddressBook{}
+	if err = readJSON(bookFile, &book); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := depot.New(dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	st, err := newStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &syncer{
+		store:  st,
+		source: relaySource{url: relayURL},
+		world:  world,
+		keys:   keys,
+		book:   book,
+	}
+	if authority != "" {
+		s.opts = append(s.opts, mail.WithTimeAuthority(authority))
+	}
+	go s.run(context.Background(), interval)
+
+	srv := server.New(&imapBackend{store: st, username: username, password: password})
+	srv.Addr = listen
+	// only meant to listen on localhost
+	srv.AllowInsecureAuth = true
+	log.Printf("listening on %s", listen)
+	log.Fatal(srv.ListenAndServe())
+}
+
+func readJSON(fname string, v interface{}) (err error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(b, v)
+}
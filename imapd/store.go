@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/schollz/maildepot/depot"
+)
+
+const (
+	// mailboxesBucket has the state of every mailbox by name
+	mailboxesBucket = "imap-mailboxes"
+	// syncedBucket has the ID of every message that was synced, and the
+	// digest of every message that was not for the user
+	syncedBucket = "imap-synced"
+	// mailboxPrefix is the prefix of the bucket with the messages of a mailbox
+	mailboxPrefix = "imap-mailbox/"
+	inbox         = "INBOX"
+	// uidValidityKey has the last UIDVALIDITY in mailboxesBucket
+	uidValidityKey = "\x00uid-validity"
+)
+
+// mailboxState is the persisted state of a mailbox.
+type mailboxState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	UIDNext     uint32 `json:"uid_next"`
+	Subscribed  bool   `json:"subscribed"`
+}
+
+// storedMessage is a decrypted message in a mailbox.
+type storedMessage struct {
+	UID   uint32    `json:"uid"`
+	ID    string    `json:"id,omitempty"`
+	Date  time.Time `json:"date"`
+	Flags []string  `json:"flags"`
+	Body  []byte    `json:"body"`
+}
+
+// store keeps the mailboxes in depot buckets. Messages are keyed by
+// their zero padded UID so that the keys are in UID order.
+type store struct {
+	db *depot.DB
+	sync.Mutex
+}
+
+func newStore(db *depot.DB) (s *store, err error) {
+	s = &store{db: db}
+	for _, bucket := range []string{mailboxesBucket, syncedBucket} {
+		err = db.NewBucket(bucket)
+		if err != nil {
+			return
+		}
+	}
+	_, err = s.mailbox(inbox)
+	if _, ok := err.(depot.NoSuchKeyError); ok {
+		err = s.createMailbox(inbox)
+	}
+	return
+}
+
+func uidKey(uid uint32) string {
+	return fmt.Sprintf("%010d", uid)
+}
+
+func (s *store) mailbox(name string) (state mailboxState, err error) {
+	err = s.db.Get(mailboxesBucket, name, &state)
+	return
+}
+
+func (s *store) mailboxNames() (names []string, err error) {
+	keys, err := s.db.GetKeysInRange(mailboxesBucket, "first", "last")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if key != uidValidityKey {
+			names = append(names, key)
+		}
+	}
+	return
+}
+
+// nextUIDValidity returns a UIDVALIDITY that is larger than every one
+// before it, so a mailbox that is created again never reuses UIDs under
+// the same UIDVALIDITY.
+func (s *store) nextUIDValidity() (validity uint32, err error) {
+	var last uint32
+	err = s.db.Get(mailboxesBucket, uidValidityKey, &last)
+	if _, ok := err.(depot.NoSuchKeyError); ok {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	validity = uint32(time.Now().Unix())
+	if validity <= last {
+		validity = last + 1
+	}
+	err = s.db.Set(mailboxesBucket, uidValidityKey, validity)
+	return
+}
+
+func (s *store) createMailbox(name string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, err = s.mailbox(name); err == nil {
+		return fmt.Errorf("mailbox '%s' already exists", name)
+	}
+	err = s.db.NewBucket(mailboxPrefix + name)
+	if err != nil {
+		return
+	}
+	validity, err := s.nextUIDValidity()
+	if err != nil {
+		return
+	}
+	return s.db.Set(mailboxesBucket, name, mailboxState{
+		UIDValidity: validity,
+		UIDNext:     1,
+		Subscribed:  true,
+	})
+}
+
+func (s *store) setSubscribed(name string, subscribed bool) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	state, err := s.mailbox(name)
+	if err != nil {
+		return
+	}
+	state.Subscribed = subscribed
+	return s.db.Set(mailboxesBucket, name, state)
+}
+
+func (s *store) deleteMailbox(name string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, err = s.mailbox(name); err != nil {
+		return
+	}
+	keys, err := s.db.GetKeysInRange(mailboxPrefix+name, "first", "last")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		err = s.db.Delete(mailboxPrefix+name, key)
+		if err != nil {
+			return
+		}
+	}
+	return s.db.Delete(mailboxesBucket, name)
+}
+
+// renameMailbox moves the messages into a new mailbox. INBOX is emptied
+// instead of being removed.
+func (s *store) renameMailbox(existingName, newName string) (err error) {
+	msgs, err := s.messages(existingName)
+	if err != nil {
+		return
+	}
+	err = s.createMailbox(newName)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		if _, err = s.add(newName, msg); err != nil {
+			return
+		}
+		if err = s.remove(existingName, msg.UID); err != nil {
+			return
+		}
+	}
+	if existingName != inbox {
+		err = s.deleteMailbox(existingName)
+	}
+	return
+}
+
+// messages returns the messages of a mailbox in UID order.
+func (s *store) messages(name string) (msgs []storedMessage, err error) {
+	if _, err = s.mailbox(name); err != nil {
+		return
+	}
+	keys, err := s.db.GetKeysInRange(mailboxPrefix+name, "first", "last")
+	if err != nil {
+		return
+	}
+	msgs = make([]storedMessage, 0, len(keys))
+	for _, key := range keys {
+		var msg storedMessage
+		err = s.db.Get(mailboxPrefix+name, key, &msg)
+		if err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// add will give the message the next UID of the mailbox and store it.
+func (s *store) add(name string, msg storedMessage) (uid uint32, err error) {
+	s.Lock()
+	defer s.Unlock()
+	state, err := s.mailbox(name)
+	if err != nil {
+		return
+	}
+	uid = state.UIDNext
+	msg.UID = uid
+	err = s.db.Set(mailboxPrefix+name, uidKey(uid), msg)
+	if err != nil {
+		return
+	}
+	state.UIDNext++
+	err = s.db.Set(mailboxesBucket, name, state)
+	return
+}
+
+// update will store the message under its existing UID.
+func (s *store) update(name string, msg storedMessage) error {
+	return s.db.Set(mailboxPrefix+name, uidKey(msg.UID), msg)
+}
+
+func (s *store) remove(name string, uid uint32) error {
+	return s.db.Delete(mailboxPrefix+name, uidKey(uid))
+}
+
+func (s *store) isSynced(id string) bool {
+	var mailbox string
+	return s.db.Get(syncedBucket, id, &mailbox) == nil
+}
+
+func (s *store) setSynced(id, mailbox string) error {
+	return s.db.Set(syncedBucket, id, mailbox)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/schollz/maildepot/eml"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/schollz/maildepot/timeauthority/authtime"
+)
+
+// source gives the messages that are on a relay.
+type source interface {
+	Messages() ([]mail.Message, error)
+}
+
+// relaySource fetches all of the messages from a relay over HTTP.
+type relaySource struct {
+	url    string
+	client *http.Client
+}
+
+func (rs relaySource) Messages() (msgs []mail.Message, err error) {
+	client := rs.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(rs.url + "/all")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("relay returned %s", resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&msgs)
+	return
+}
+
+// syncer opens the new messages from a source and puts them in INBOX.
+type syncer struct {
+	store  *store
+	source source
+	world  keypair.KeyPair
+	keys   []keypair.KeyPair
+	book   eml.AddressBook
+	opts   []mail.OpenOption
+}
+
+// sync will open every message that was not synced before and returns the
+// number of messages that were added to INBOX. Messages that are not for
+// the user are remembered by their digest so they are only tried once,
+// while a copy with the same ID and other recipients is still tried.
+func (s *syncer) sync(ctx context.Context) (added int, err error) {
+	all, err := s.source.Messages()
+	if err != nil {
+		return
+	}
+	msgs := mail.Messages{}
+	for _, m := range all {
+		if !s.store.isSynced(m.ID()) && !s.store.isSynced(m.Digest()) {
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) == 0 {
+		return
+	}
+
+	// the workers of OpenAll stop when a failure returns early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results, err := mail.OpenAll(ctx, s.world, s.keys, &msgs, s.opts...)
+	if err != nil {
+		return
+	}
+	for r := range results {
+		id := r.Message.ID()
+		switch r.Err {
+		case nil:
+		case mail.ErrNotForMe:
+			if err = s.store.setSynced(r.Message.Digest(), ""); err != nil {
+				return
+			}
+			continue
+		default:
+			// it may open later, for example when the time authority is back
+			log.Printf("could not open %s: %s", id, r.Err)
+			continue
+		}
+
+		var raw []byte
+		raw, err = eml.Export(r.OpenMessage, s.book)
+		if err != nil {
+			return
+		}
+		_, err = s.store.add(inbox, storedMessage{
+			ID:   id,
+			Date: internalDate(r.Message),
+			Body: raw,
+		})
+		if err != nil {
+			return
+		}
+		if err = s.store.setSynced(id, inbox); err != nil {
+			return
+		}
+		added++
+	}
+	err = ctx.Err()
+	return
+}
+
+// internalDate returns the time of the message from the time authority,
+// which was checked when it was opened, or the time it is synced.
+func internalDate(m mail.Message) time.Time {
+	if m.Time != "" {
+		if t, err := authtime.Parse(m.Time); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// run syncs every interval until the context is done.
+func (s *syncer) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		added, err := s.sync(ctx)
+		if err != nil {
+			log.Println(err)
+		} else if added > 0 {
+			log.Printf("synced %d messages", added)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
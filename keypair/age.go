@@ -0,0 +1,72 @@
+package keypair
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	ageRecipientHRP = "age"
+	ageIdentityHRP  = "AGE-SECRET-KEY-"
+)
+
+// AgeRecipient will return the public key as an age X25519 recipient
+// ("age1..."), since both use the same curve25519 keys.
+func (kp KeyPair) AgeRecipient() (recipient string, err error) {
+	if kp.public == nil {
+		kp, err = New(kp)
+		if err != nil {
+			return
+		}
+	}
+	return bech32Encode(ageRecipientHRP, kp.public[:])
+}
+
+// AgeIdentity will return the private key as an age X25519 identity
+// ("AGE-SECRET-KEY-1...").
+func (kp KeyPair) AgeIdentity() (identity string, err error) {
+	if kp.private == nil {
+		kp, err = New(kp)
+		if err != nil {
+			return
+		}
+		if kp.private == nil {
+			err = ErrNoPrivateKey
+			return
+		}
+	}
+	identity, err = bech32Encode(ageIdentityHRP, kp.private[:])
+	identity = strings.ToUpper(identity)
+	return
+}
+
+// NewFromAge will load a key pair from an age X25519 recipient, which
+// gives only the public key, or from an age X25519 identity.
+func NewFromAge(s string) (kp KeyPair, err error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return
+	}
+	if len(data) != 32 {
+		err = ErrMalformed
+		return
+	}
+	switch hrp {
+	case ageRecipientHRP:
+		return New(KeyPair{Public: base64.StdEncoding.EncodeToString(data)})
+	case strings.ToLower(ageIdentityHRP):
+		var public []byte
+		public, err = curve25519.X25519(data, curve25519.Basepoint)
+		if err != nil {
+			return
+		}
+		return New(KeyPair{
+			Public:  base64.StdEncoding.EncodeToString(public),
+			Private: base64.StdEncoding.EncodeToString(data),
+		})
+	}
+	err = ErrMalformed
+	return
+}
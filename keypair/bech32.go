@@ -0,0 +1,114 @@
+package keypair
+
+import (
+	"errors"
+	"strings"
+)
+
+// bech32 encoding (BIP 173), which age uses for its keys.
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= bech32Generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	h := []byte(strings.ToLower(hrp))
+	ret := make([]byte, 0, len(h)*2+1)
+	for _, c := range h {
+		ret = append(ret, c>>5)
+	}
+	ret = append(ret, 0)
+	for _, c := range h {
+		ret = append(ret, c&31)
+	}
+	return ret
+}
+
+// convertBits regroups the bits of data from frombits to tobits wide.
+func convertBits(data []byte, frombits, tobits uint, pad bool) (out []byte, err error) {
+	acc, bits := uint32(0), uint(0)
+	maxv := byte(1<<tobits - 1)
+	for _, value := range data {
+		if value>>frombits != 0 {
+			err = errors.New("bech32: invalid data range")
+			return
+		}
+		acc = acc<<frombits | uint32(value)
+		bits += frombits
+		for bits >= tobits {
+			bits -= tobits
+			out = append(out, byte(acc>>bits)&maxv)
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(tobits-bits))&maxv)
+		}
+	} else if bits >= frombits || byte(acc<<(tobits-bits))&maxv != 0 {
+		err = errors.New("bech32: invalid padding")
+	}
+	return
+}
+
+func bech32Encode(hrp string, data []byte) (s string, err error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return
+	}
+	hrp = strings.ToLower(hrp)
+	polymod := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		b.WriteByte(bech32Charset[(polymod>>uint(5*(5-i)))&31])
+	}
+	s = b.String()
+	return
+}
+
+func bech32Decode(s string) (hrp string, data []byte, err error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		err = errors.New("bech32: mixed case")
+		return
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndex(s, "1")
+	if pos < 1 || pos+7 > len(s) {
+		err = errors.New("bech32: invalid separator")
+		return
+	}
+	hrp = s[:pos]
+	values := make([]byte, 0, len(s)-pos-1)
+	for _, c := range s[pos+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i < 0 {
+			err = errors.New("bech32: invalid character")
+			return
+		}
+		values = append(values, byte(i))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		err = errors.New("bech32: invalid checksum")
+		return
+	}
+	data, err = convertBits(values[:len(values)-6], 5, 8, false)
+	return
+}
@@ -3,6 +3,7 @@ package keypair
 import (
 	"bytes"
 	crypto_rand "crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -10,9 +11,19 @@ import (
 	"io"
 	math_rand "math/rand"
 
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/box"
 )
 
+var (
+	// ErrMalformed is returned for keys and encrypted messages with the wrong length.
+	ErrMalformed = errors.New("keypair: malformed input")
+	// ErrNoPrivateKey is returned when encrypting or decrypting without a private key.
+	ErrNoPrivateKey = errors.New("keypair: missing private key")
+	// ErrDecryptionFailed is returned when a message does not authenticate.
+	ErrDecryptionFailed = errors.New("keypair decryption failed")
+)
+
 type KeyPair struct {
 	Public  string `json:"public"`
 	Private string `json:"private,omitempty"`
@@ -98,14 +109,22 @@ func keyToBytes(s string) (key *[32]byte, err error) {
 		return
 	}
 	keyBytes = keyBytes[:i]
+	if len(keyBytes) != 32 {
+		err = ErrMalformed
+		return
+	}
 
 	key = new([32]byte)
-	copy(key[:], keyBytes[:32])
+	copy(key[:], keyBytes)
 	return
 }
 
 // Encrypt a message for a recipient
 func (kp KeyPair) Encrypt(msg []byte, recipientPublicKey string) (encrypted []byte, err error) {
+	if kp.private == nil {
+		err = ErrNoPrivateKey
+		return
+	}
 	recipient, err := New(KeyPair{Public: recipientPublicKey})
 	if err != nil {
 		return
@@ -116,6 +135,10 @@ func (kp KeyPair) Encrypt(msg []byte, recipientPublicKey string) (encrypted []by
 
 // Decrypt a message
 func (kp KeyPair) Decrypt(encrypted []byte, senderPublicKey string) (msg []byte, err error) {
+	if kp.private == nil {
+		err = ErrNoPrivateKey
+		return
+	}
 	sender, err := New(KeyPair{Public: senderPublicKey})
 	if err != nil {
 		return
@@ -126,6 +149,10 @@ func (kp KeyPair) Decrypt(encrypted []byte, senderPublicKey string) (msg []byte,
 
 // DecryptBase64 a message
 func (kp KeyPair) DecryptBase64(encryptedBase64 string, senderPublicKey string) (msg []byte, err error) {
+	if kp.private == nil {
+		err = ErrNoPrivateKey
+		return
+	}
 	sender, err := New(KeyPair{Public: senderPublicKey})
 	if err != nil {
 		return
@@ -138,6 +165,72 @@ func (kp KeyPair) DecryptBase64(encryptedBase64 string, senderPublicKey string)
 	return
 }
 
+// SharedKey is a precomputed key between a key pair and a sender, which
+// makes decrypting many messages from the same sender much faster.
+type SharedKey struct {
+	key *[32]byte
+}
+
+// Precompute will compute the shared key with the sender.
+func (kp KeyPair) Precompute(senderPublicKey string) (sk SharedKey, err error) {
+	if kp.private == nil {
+		err = ErrNoPrivateKey
+		return
+	}
+	sender, err := New(KeyPair{Public: senderPublicKey})
+	if err != nil {
+		return
+	}
+	sk.key = new([32]byte)
+	box.Precompute(sk.key, sender.public, kp.private)
+	return
+}
+
+// Encrypt a message with the shared key
+func (sk SharedKey) Encrypt(msg []byte) (encrypted []byte, err error) {
+	if sk.key == nil {
+		err = ErrNoPrivateKey
+		return
+	}
+	var nonce [24]byte
+	if _, err = io.ReadFull(crypto_rand.Reader, nonce[:]); err != nil {
+		return
+	}
+	encrypted = box.SealAfterPrecomputation(nonce[:], msg, &nonce, sk.key)
+	return
+}
+
+// Derive will derive a 32 byte key from the shared key with HKDF-SHA256,
+// so that other ciphers do not use the box key directly.
+func (sk SharedKey) Derive(info string) (key [32]byte, err error) {
+	if sk.key == nil {
+		err = ErrNoPrivateKey
+		return
+	}
+	_, err = io.ReadFull(hkdf.New(sha256.New, sk.key[:], nil, []byte(info)), key[:])
+	return
+}
+
+// Decrypt a message with the shared key
+func (sk SharedKey) Decrypt(enc []byte) (decrypted []byte, err error) {
+	if sk.key == nil {
+		err = ErrNoPrivateKey
+		return
+	}
+	if len(enc) < 24+box.Overhead {
+		err = ErrMalformed
+		return
+	}
+	var decryptNonce [24]byte
+	copy(decryptNonce[:], enc[:24])
+	var ok bool
+	decrypted, ok = box.OpenAfterPrecomputation(nil, enc[24:], &decryptNonce, sk.key)
+	if !ok {
+		err = ErrDecryptionFailed
+	}
+	return
+}
+
 func encryptWithKeyPair(msg []byte, senderPrivateKey, recipientPublicKey *[32]byte) (encrypted []byte, err error) {
 	// You must use a different nonce for each message you encrypt with the
 	// same key. Since the nonce here is 192 bits long, a random value
@@ -157,19 +250,23 @@ func decryptWithKeyPair(enc []byte, senderPublicKey, recipientPrivateKey *[32]by
 	// used to encrypt the message. One way to achieve this is to store the
 	// nonce alongside the encrypted message. Above, we stored the nonce in the
 	// first 24 bytes of the encrypted text.
+	if len(enc) < 24+box.Overhead {
+		err = ErrMalformed
+		return
+	}
 	var decryptNonce [24]byte
 	copy(decryptNonce[:], enc[:24])
 	var ok bool
 	decrypted, ok = box.Open(nil, enc[24:], &decryptNonce, senderPublicKey, recipientPrivateKey)
 	if !ok {
-		err = errors.New("keypair decryption failed")
+		err = ErrDecryptionFailed
 	}
 	return
 }
 
 func GetNonce(enc []byte) []byte {
 	var decryptNonce [24]byte
-	copy(decryptNonce[:], enc[:24])
+	copy(decryptNonce[:], enc)
 	return decryptNonce[:]
 }
 
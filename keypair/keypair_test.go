@@ -26,7 +26,7 @@ func TestTweetNaClKeyPair(t *testing.T) {
 	fmt.Println("Box:", base64.StdEncoding.EncodeToString(enc[24:]))
 }
 
-func ExampleTweetNaClKeyPair2() {
+func ExampleKeyPair_DecryptBase64() {
 	// keypair from https://tweetnacl.js.org/#/box
 	me, err := New(KeyPair{
 		Public:  "4zFzzJjggRJMM4UNkiH41wtohL581KfIgBc5Anx3KEo=",
@@ -76,3 +76,71 @@ func TestBasic(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.NotEqual(t, msg, dec)
 }
+
+func TestMalformed(t *testing.T) {
+	_, err := New(KeyPair{Public: "c2hvcnQ="})
+	assert.Equal(t, ErrMalformed, err)
+	_, err = NewFromPublic("")
+	assert.Equal(t, ErrMalformed, err)
+
+	bob, _ := New()
+	for _, enc := range [][]byte{nil, []byte("short"), make([]byte, 24)} {
+		_, err = bob.Decrypt(enc, bob.Public)
+		assert.Equal(t, ErrMalformed, err)
+	}
+	_, err = bob.Decrypt(make([]byte, 64), bob.Public)
+	assert.Equal(t, ErrDecryptionFailed, err)
+
+	public, _ := NewFromPublic(bob.Public)
+	_, err = public.Encrypt([]byte("hello, world"), bob.Public)
+	assert.Equal(t, ErrNoPrivateKey, err)
+	_, err = public.Decrypt(make([]byte, 64), bob.Public)
+	assert.Equal(t, ErrNoPrivateKey, err)
+	assert.Equal(t, 24, len(GetNonce(nil)))
+}
+
+func TestPrecompute(t *testing.T) {
+	bob, _ := New()
+	jane, _ := New()
+	enc, _ := bob.Encrypt([]byte("hello, world"), jane.Public)
+	shared, err := jane.Precompute(bob.Public)
+	assert.Nil(t, err)
+	dec, err := shared.Decrypt(enc)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello, world"), dec)
+
+	_, err = SharedKey{}.Decrypt(enc)
+	assert.Equal(t, ErrNoPrivateKey, err)
+	_, err = shared.Decrypt(enc[:10])
+	assert.Equal(t, ErrMalformed, err)
+}
+
+func TestAge(t *testing.T) {
+	kp, _ := New()
+	recipient, err := kp.AgeRecipient()
+	assert.Nil(t, err)
+	identity, err := kp.AgeIdentity()
+	assert.Nil(t, err)
+
+	fromRecipient, err := NewFromAge(recipient)
+	assert.Nil(t, err)
+	assert.Equal(t, kp.Public, fromRecipient.Public)
+	assert.Equal(t, "", fromRecipient.Private)
+	_, err = fromRecipient.AgeIdentity()
+	assert.Equal(t, ErrNoPrivateKey, err)
+
+	fromIdentity, err := NewFromAge(identity)
+	assert.Nil(t, err)
+	assert.Equal(t, kp.Public, fromIdentity.Public)
+	assert.Equal(t, kp.Private, fromIdentity.Private)
+
+	// a changed checksum character
+	last := "q"
+	if recipient[len(recipient)-1] == 'q' {
+		last = "p"
+	}
+	_, err = NewFromAge(recipient[:len(recipient)-1] + last)
+	assert.NotNil(t, err)
+	_, err = NewFromAge("age1qqqqqqqq")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,364 @@
+package mail
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/maildepot/keypair"
+	"golang.org/x/crypto/nacl/sign"
+)
+
+const (
+	channelKeysKind      = "channel-keys"
+	channelPostKind      = "post"
+	channelRotateKind    = "rotate"
+	channelSubscribeKind = "subscribe"
+)
+
+// Channel is a one-to-many broadcast from a single publisher. The
+// publisher gives subscribers the channel key once, when they ask for it
+// with a signed subscription request, and every post is wrapped only for
+// the channel key and signed by the publisher. When the channel key is
+// rotated the new key is sent to every current member, so subscribers
+// that were removed can not read the posts after it.
+type Channel struct {
+	// Name is a human readable name of the channel
+	Name string `json:"name"`
+	// VerifyKey is the public signing key of the publisher
+	VerifyKey string `json:"verify"`
+	// SignKey is the private signing key, only known to the publisher
+	SignKey string `json:"sign,omitempty"`
+	// Epoch is the current version of the channel key
+	Epoch int `json:"epoch"`
+	// EpochKeys contains the channel key of every epoch that is known
+	EpochKeys map[int]keypair.KeyPair `json:"keys"`
+	// RotateEvery is how often the publisher should rotate the channel key
+	RotateEvery time.Duration `json:"rotate_every"`
+	// Rotated is when the channel key was last rotated
+	Rotated time.Time `json:"rotated"`
+	// Members are the public keys of the subscribers, only known to the
+	// publisher
+	Members []string `json:"members,omitempty"`
+}
+
+// ChannelPost is an opened and verified channel post.
+type ChannelPost struct {
+	// Epoch is the epoch of the key the post was written with
+	Epoch int
+	// Rotation is true if the post announced a new channel key
+	Rotation bool
+	// MessageBytes is the payload
+	MessageBytes []byte
+}
+
+type channelKeys struct {
+	Kind      string                  `json:"kind"`
+	Name      string                  `json:"name"`
+	VerifyKey string                  `json:"verify"`
+	Epoch     int                     `json:"epoch"`
+	Keys      map[int]keypair.KeyPair `json:"keys"`
+}
+
+type channelSubscription struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Subscriber string `json:"subscriber"`
+	// Proof is the name encrypted from the subscriber to the publisher,
+	// which only the subscriber (or the publisher) can make
+	Proof []byte `json:"proof"`
+}
+
+type channelPost struct {
+	Kind    string           `json:"kind"`
+	Name    string           `json:"name"`
+	Epoch   int              `json:"epoch"`
+	Key     *keypair.KeyPair `json:"key,omitempty"`
+	Payload []byte           `json:"payload,omitempty"`
+}
+
+// NewChannel will generate a new channel with a new signing key and the
+// first epoch key.
+func NewChannel(name string, rotateEvery time.Duration) (c *Channel, err error) {
+	verifyKey, signKey, err := sign.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		return
+	}
+	channelKey, err := keypair.New()
+	if err != nil {
+		return
+	}
+	c = &Channel{
+		Name:        name,
+		VerifyKey:   base64.StdEncoding.EncodeToString(verifyKey[:]),
+		SignKey:     base64.StdEncoding.EncodeToString(signKey[:]),
+		EpochKeys:   map[int]keypair.KeyPair{0: channelKey},
+		RotateEvery: rotateEvery,
+		Rotated:     time.Now().UTC(),
+	}
+	return
+}
+
+// Key returns the channel key of the current epoch.
+func (c *Channel) Key() keypair.KeyPair {
+	return c.EpochKeys[c.Epoch]
+}
+
+// Keys returns the channel keys of every known epoch.
+func (c *Channel) Keys() (keys []keypair.KeyPair) {
+	keys = make([]keypair.KeyPair, 0, len(c.EpochKeys))
+	for epoch := c.Epoch; epoch >= 0; epoch-- {
+		if key, ok := c.EpochKeys[epoch]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// NeedsRotation returns true when the channel key is older than RotateEvery.
+func (c *Channel) NeedsRotation() bool {
+	return c.RotateEvery > 0 && time.Since(c.Rotated) > c.RotateEvery
+}
+
+// RequestSubscription will generate a message that asks the publisher
+// to subscribe to the channel. It is signed with the key of the
+// subscriber, so nobody can subscribe someone else.
+func RequestSubscription(world keypair.KeyPair, subscriber keypair.KeyPair, publisher string, name string) (m Message, err error) {
+	proof, err := subscriber.Encrypt([]byte(channelSubscribeKind+":"+name), publisher)
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(channelSubscription{
+		Kind:       channelSubscribeKind,
+		Name:       name,
+		Subscriber: subscriber.Public,
+		Proof:      proof,
+	})
+	if err != nil {
+		return
+	}
+	return New(world, subscriber, []string{publisher}, payload)
+}
+
+// Subscribe will check an opened subscription request and generate a
+// message for the subscriber that contains the channel key of the
+// current epoch.
+func (c *Channel) Subscribe(world keypair.KeyPair, publisher keypair.KeyPair, request OpenMessage) (m Message, err error) {
+	if c.SignKey == "" {
+		err = fmt.Errorf("only the publisher can add subscribers")
+		return
+	}
+	var cs channelSubscription
+	if err = json.Unmarshal(request.MessageBytes, &cs); err != nil {
+		err = errors.Wrap(err, "message is not a subscription request")
+		return
+	}
+	if cs.Kind != channelSubscribeKind || cs.Name != c.Name {
+		err = fmt.Errorf("message is not a subscription request for '%s'", c.Name)
+		return
+	}
+	proof, err := publisher.Decrypt(cs.Proof, cs.Subscriber)
+	if err != nil || string(proof) != channelSubscribeKind+":"+c.Name {
+		err = fmt.Errorf("subscription request is not signed by the subscriber")
+		return
+	}
+	subscriber := cs.Subscriber
+	payload, err := json.Marshal(channelKeys{
+		Kind:      channelKeysKind,
+		Name:      c.Name,
+		VerifyKey: c.VerifyKey,
+		Epoch:     c.Epoch,
+		Keys:      map[int]keypair.KeyPair{c.Epoch: c.Key()},
+	})
+	if err != nil {
+		return
+	}
+	m, err = New(world, publisher, []string{subscriber}, payload)
+	if err != nil {
+		return
+	}
+	for _, member := range c.Members {
+		if member == subscriber {
+			return
+		}
+	}
+	c.Members = append(c.Members, subscriber)
+	return
+}
+
+// Unsubscribe removes a subscriber, who can not read the posts after the
+// next rotation.
+func (c *Channel) Unsubscribe(subscriber string) {
+	for i, member := range c.Members {
+		if member == subscriber {
+			c.Members = append(c.Members[:i], c.Members[i+1:]...)
+			return
+		}
+	}
+}
+
+// JoinChannel will create a channel from an opened subscription message.
+func JoinChannel(openMsg OpenMessage) (c *Channel, err error) {
+	var ck channelKeys
+	err = json.Unmarshal(openMsg.MessageBytes, &ck)
+	if err != nil {
+		err = errors.Wrap(err, "message does not contain channel keys")
+		return
+	}
+	if ck.Kind != channelKeysKind {
+		err = fmt.Errorf("message does not contain channel keys")
+		return
+	}
+	c = &Channel{
+		Name:      ck.Name,
+		VerifyKey: ck.VerifyKey,
+		Epoch:     ck.Epoch,
+		EpochKeys: make(map[int]keypair.KeyPair),
+	}
+	for epoch, key := range ck.Keys {
+		key, err = keypair.New(key)
+		if err != nil {
+			err = errors.Wrap(err, "bad channel key")
+			return
+		}
+		c.EpochKeys[epoch] = key
+	}
+	return
+}
+
+// Post will generate a signed message for the channel.
+func (c *Channel) Post(world keypair.KeyPair, publisher keypair.KeyPair, msg []byte) (m Message, err error) {
+	return c.post(world, publisher, []string{c.Key().Public}, channelPost{
+		Kind:    channelPostKind,
+		Name:    c.Name,
+		Epoch:   c.Epoch,
+		Payload: msg,
+	})
+}
+
+// Rotate will generate the channel key for the next epoch and returns
+// the post announcing it, which is encrypted for every member. Nobody
+// else can follow the new key, even with the keys of earlier epochs.
+func (c *Channel) Rotate(world keypair.KeyPair, publisher keypair.KeyPair) (m Message, err error) {
+	if len(c.Members) == 0 {
+		err = fmt.Errorf("channel has no members")
+		return
+	}
+	channelKey, err := keypair.New()
+	if err != nil {
+		return
+	}
+	m, err = c.post(world, publisher, c.Members, channelPost{
+		Kind:  channelRotateKind,
+		Name:  c.Name,
+		Epoch: c.Epoch + 1,
+		Key:   &channelKey,
+	})
+	if err != nil {
+		return
+	}
+	c.Epoch++
+	c.EpochKeys[c.Epoch] = channelKey
+	c.Rotated = time.Now().UTC()
+	return
+}
+
+func (c *Channel) post(world keypair.KeyPair, publisher keypair.KeyPair, recipients []string, p channelPost) (m Message, err error) {
+	if c.SignKey == "" {
+		err = fmt.Errorf("only the publisher can post")
+		return
+	}
+	signKeyBytes, err := base64.StdEncoding.DecodeString(c.SignKey)
+	if err != nil || len(signKeyBytes) != 64 {
+		err = fmt.Errorf("bad signing key")
+		return
+	}
+	var signKey [64]byte
+	copy(signKey[:], signKeyBytes)
+
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	signed := sign.Sign(nil, payload, &signKey)
+	return New(world, publisher, recipients, signed)
+}
+
+// Open will open and verify a channel post. Posts that rotate the channel
+// key are encrypted for the members, so they need the keys of the
+// subscriber, and are applied to the channel before returning.
+func (c *Channel) Open(world keypair.KeyPair, m Message, mykeys ...keypair.KeyPair) (post ChannelPost, err error) {
+	openMsg, err := m.Open(world, append(c.Keys(), mykeys...))
+	if err != nil {
+		return
+	}
+
+	verifyKeyBytes, err := base64.StdEncoding.DecodeString(c.VerifyKey)
+	if err != nil || len(verifyKeyBytes) != 32 {
+		err = fmt.Errorf("bad verify key")
+		return
+	}
+	var verifyKey [32]byte
+	copy(verifyKey[:], verifyKeyBytes)
+	payload, ok := sign.Open(nil, openMsg.MessageBytes, &verifyKey)
+	if !ok {
+		err = fmt.Errorf("post is not signed by the publisher")
+		return
+	}
+
+	var p channelPost
+	err = json.Unmarshal(payload, &p)
+	if err != nil {
+		err = errors.Wrap(err, "malformed post")
+		return
+	}
+	if p.Name != c.Name {
+		err = fmt.Errorf("post is for channel '%s'", p.Name)
+		return
+	}
+	// the key used to open the post has to belong to the epoch it claims,
+	// and rotations are only opened with the keys of the subscriber
+	epochKey, ok := c.EpochKeys[p.Epoch]
+	if p.Kind == channelRotateKind {
+		ok = !c.isEpochKey(openMsg.Recipients[0].Public)
+	} else if ok {
+		ok = epochKey.Public == openMsg.Recipients[0].Public
+	}
+	if !ok {
+		err = fmt.Errorf("post has wrong epoch")
+		return
+	}
+
+	post.Epoch = p.Epoch
+	post.MessageBytes = p.Payload
+	if p.Kind == channelRotateKind {
+		if p.Key == nil {
+			err = fmt.Errorf("rotation is missing the key")
+			return
+		}
+		var channelKey keypair.KeyPair
+		channelKey, err = keypair.New(*p.Key)
+		if err != nil {
+			err = errors.Wrap(err, "bad channel key")
+			return
+		}
+		post.Rotation = true
+		c.EpochKeys[p.Epoch] = channelKey
+		if p.Epoch > c.Epoch {
+			c.Epoch = p.Epoch
+		}
+	}
+	return
+}
+
+func (c *Channel) isEpochKey(public string) bool {
+	for _, key := range c.EpochKeys {
+		if key.Public == public {
+			return true
+		}
+	}
+	return false
+}
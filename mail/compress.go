@@ -0,0 +1,95 @@
+package mail
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MaxDecompressedSize is the largest payload that Open will decompress,
+// which protects against decompression bombs.
+var MaxDecompressedSize int64 = 16 << 20
+
+// Compression is the algorithm used to compress the payload before it
+// is padded and encrypted.
+type Compression byte
+
+const (
+	// CompressNone does not compress
+	CompressNone Compression = iota
+	// CompressDeflate compresses with deflate
+	CompressDeflate
+	// CompressZstd compresses with zstd
+	CompressZstd
+)
+
+// compressionMask are the bits of the envelope flags for the compression.
+const compressionMask = 0x03
+
+func compress(body []byte, c Compression) (compressed []byte, err error) {
+	var buf bytes.Buffer
+	switch c {
+	case CompressNone:
+		return body, nil
+	case CompressDeflate:
+		var w *flate.Writer
+		w, err = flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return
+		}
+		if _, err = w.Write(body); err != nil {
+			return
+		}
+		err = w.Close()
+	case CompressZstd:
+		var w *zstd.Encoder
+		w, err = zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		if err != nil {
+			return
+		}
+		if _, err = w.Write(body); err != nil {
+			return
+		}
+		err = w.Close()
+	default:
+		err = fmt.Errorf("unknown compression %d", c)
+	}
+	compressed = buf.Bytes()
+	return
+}
+
+func decompress(compressed []byte, c Compression) (body []byte, err error) {
+	var r io.Reader
+	switch c {
+	case CompressNone:
+		return compressed, nil
+	case CompressDeflate:
+		fr := flate.NewReader(bytes.NewReader(compressed))
+		defer fr.Close()
+		r = fr
+	case CompressZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderMaxMemory(uint64(MaxDecompressedSize)))
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		err = fmt.Errorf("unknown compression %d", c)
+		return
+	}
+
+	body, err = ioutil.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return
+	}
+	if int64(len(body)) > MaxDecompressedSize {
+		err = fmt.Errorf("decompressed payload is larger than %d bytes", MaxDecompressedSize)
+	}
+	return
+}
@@ -0,0 +1,166 @@
+package mail
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// EnvelopeVersion is the current version of the payload envelope. Messages
+// without a version carry the raw payload.
+const EnvelopeVersion = 1
+
+// The envelope starts with one byte of flags. The low bits are the
+// compression and every other flag that is set is followed by a section
+// with four bytes of length. Then comes four bytes of body length, the
+// body and the padding.
+const (
+	flagExpiry = 1 << 2
+	flagHeader = 1 << 3
+)
+
+// envelope is the decrypted content of a message.
+type envelope struct {
+	flags byte
+	// time and ttl are the authenticated time and time to live, which
+	// have to match the ones on the outside of the message
+	time string
+	ttl  int64
+	// header is the JSON encoded header
+	header []byte
+	body   []byte
+}
+
+// Padding is a scheme that decides how long a padded payload is.
+type Padding int
+
+const (
+	// PadNone does not pad
+	PadNone Padding = iota
+	// PadPadme pads to the Padmé buckets, which leak O(log log n) bits
+	// with at most 12% overhead
+	PadPadme
+	// PadPowerOfTwo pads to the next power of two
+	PadPowerOfTwo
+)
+
+// size returns the padded length of n bytes.
+func (p Padding) size(n int) int {
+	if n < 2 {
+		return n
+	}
+	switch p {
+	case PadPadme:
+		e := bits.Len(uint(n)) - 1
+		s := bits.Len(uint(e))
+		lastBits := e - s
+		bitMask := 1<<uint(lastBits) - 1
+		return (n + bitMask) &^ bitMask
+	case PadPowerOfTwo:
+		return 1 << uint(bits.Len(uint(n-1)))
+	}
+	return n
+}
+
+// sealEnvelope compresses the payload, puts it into an envelope and pads it.
+func sealEnvelope(body []byte, o options) (plaintext []byte, err error) {
+	var flags byte
+	if o.compression != CompressNone {
+		var compressed []byte
+		compressed, err = compress(body, o.compression)
+		if err != nil {
+			return
+		}
+		// only keep the compressed body if it helps
+		if len(compressed) < len(body) {
+			body = compressed
+			flags |= byte(o.compression) & compressionMask
+		}
+	}
+
+	var sections [][]byte
+	if o.expiryTime != "" {
+		flags |= flagExpiry
+		expiry := make([]byte, 8+len(o.expiryTime))
+		binary.BigEndian.PutUint64(expiry, uint64(o.ttl))
+		copy(expiry[8:], o.expiryTime)
+		sections = append(sections, expiry)
+	}
+	if len(o.header) > 0 {
+		flags |= flagHeader
+		sections = append(sections, o.header)
+	}
+	sections = append(sections, body)
+
+	n := 1
+	for _, section := range sections {
+		n += 4 + len(section)
+	}
+	plaintext = make([]byte, 1, o.padding.size(n))
+	plaintext[0] = flags
+	for _, section := range sections {
+		plaintext = appendSection(plaintext, section)
+	}
+	plaintext = plaintext[:cap(plaintext)]
+	return
+}
+
+// openEnvelope reads the envelope and decompresses the payload.
+func openEnvelope(plaintext []byte) (env envelope, err error) {
+	if len(plaintext) < 1 {
+		err = errors.Wrap(ErrMalformed, "envelope is too short")
+		return
+	}
+	env.flags = plaintext[0]
+	rest := plaintext[1:]
+	if env.flags&flagExpiry != 0 {
+		var expiry []byte
+		expiry, rest, err = readSection(rest)
+		if err != nil {
+			return
+		}
+		if len(expiry) < 8 {
+			err = errors.Wrap(ErrMalformed, "envelope expiry is too short")
+			return
+		}
+		env.ttl = int64(binary.BigEndian.Uint64(expiry))
+		env.time = string(expiry[8:])
+	}
+	if env.flags&flagHeader != 0 {
+		env.header, rest, err = readSection(rest)
+		if err != nil {
+			return
+		}
+	}
+	env.body, _, err = readSection(rest)
+	if err != nil {
+		return
+	}
+	env.body, err = decompress(env.body, Compression(env.flags&compressionMask))
+	if err != nil {
+		err = errors.Wrap(ErrMalformed, err.Error())
+	}
+	return
+}
+
+func appendSection(b []byte, section []byte) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(section)))
+	return append(append(b, n[:]...), section...)
+}
+
+func readSection(b []byte) (section []byte, rest []byte, err error) {
+	if len(b) < 4 {
+		err = errors.Wrap(ErrMalformed, "envelope is too short")
+		return
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		err = errors.Wrap(ErrMalformed, "envelope section is truncated")
+		return
+	}
+	section = b[4 : 4+n]
+	rest = b[4+n:]
+	return
+}
@@ -0,0 +1,20 @@
+package mail
+
+import "errors"
+
+var (
+	// ErrMalformed is returned when a message can not be decoded.
+	ErrMalformed = errors.New("message is malformed")
+	// ErrNotForMe is returned when none of the keys is a recipient.
+	ErrNotForMe = errors.New("could not find valid recipient")
+	// ErrWrongWorld is returned when a message is not from the world.
+	ErrWrongWorld = errors.New("message is not from this world")
+	// ErrTampered is returned when a message fails authentication after
+	// the message key was found.
+	ErrTampered = errors.New("message has been tampered with")
+	// ErrExpired is returned when opening a message past its expiry.
+	ErrExpired = errors.New("message has expired")
+	// ErrSuiteNotAllowed is returned when the suite of a message is not
+	// acceptable to the policy.
+	ErrSuiteNotAllowed = errors.New("message suite is not allowed")
+)
@@ -0,0 +1,53 @@
+package mail
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/schollz/maildepot/timeauthority/authtime"
+)
+
+// Expiry returns when the message expires, which is the authenticated
+// time of the message plus its time to live. The authenticated time is
+// checked against the base58 public key of the time authority, unless
+// it is empty. Messages without a time never expire and return a zero time.
+func (m *Message) Expiry(authority string) (expiry time.Time, err error) {
+	if m.Time == "" {
+		return
+	}
+	var t time.Time
+	if authority == "" {
+		t, err = authtime.Parse(m.Time)
+	} else {
+		t, err = authtime.Authenticate(m.Time, authority)
+	}
+	if err != nil {
+		return
+	}
+	expiry = t.Add(time.Duration(m.TTL) * time.Second)
+	return
+}
+
+// IsExpired returns true if the message has expired at the given time.
+// Messages whose time can not be authenticated count as expired.
+func (m *Message) IsExpired(authority string, now time.Time) bool {
+	if m.Time == "" {
+		return false
+	}
+	expiry, err := m.Expiry(authority)
+	return err != nil || now.After(expiry)
+}
+
+// Expired returns a function that tells if a stored message has expired at
+// the given time, for depot.DeleteExpired. Values that are not messages or
+// whose time can not be authenticated do not count as expired.
+func Expired(authority string, now time.Time) func(value []byte) bool {
+	return func(value []byte) bool {
+		var m Message
+		if json.Unmarshal(value, &m) != nil || m.Time == "" {
+			return false
+		}
+		expiry, err := m.Expiry(authority)
+		return err == nil && now.After(expiry)
+	}
+}
@@ -0,0 +1,259 @@
+package mail
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/maildepot/keypair"
+	"golang.org/x/crypto/nacl/sign"
+)
+
+const groupKeysKind = "group-keys"
+
+// Group is a mailbox shared by its members through a group key. Messages
+// are sent to the group key so they only need one wrap, and the group
+// key is replaced (with a new epoch) whenever a member is removed. Key
+// updates are signed by the owner, since the sender of a message is not
+// authenticated.
+type Group struct {
+	// Name is a human readable name of the group
+	Name string `json:"name"`
+	// Owner is the public key of whoever manages the group key
+	Owner string `json:"owner"`
+	// VerifyKey is the public signing key of the owner, any key updates
+	// not signed with it are rejected
+	VerifyKey string `json:"verify"`
+	// SignKey is the private signing key, only known to the owner
+	SignKey string `json:"sign,omitempty"`
+	// Epoch is the current version of the group key
+	Epoch int `json:"epoch"`
+	// Members is the list of public keys of the members
+	Members []string `json:"members"`
+	// EpochKeys contains the group key of every epoch that is known
+	EpochKeys map[int]keypair.KeyPair `json:"keys"`
+}
+
+// GroupKeys is the payload of a message that distributes group keys.
+type GroupKeys struct {
+	Kind      string                  `json:"kind"`
+	Name      string                  `json:"name"`
+	VerifyKey string                  `json:"verify"`
+	Epoch     int                     `json:"epoch"`
+	Members   []string                `json:"members"`
+	Keys      map[int]keypair.KeyPair `json:"keys"`
+}
+
+// NewGroup will generate a new group owned by owner with the first epoch key.
+func NewGroup(name string, owner keypair.KeyPair, members []string) (g *Group, err error) {
+	verifyKey, signKey, err := sign.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		return
+	}
+	g = &Group{
+		Name:      name,
+		Owner:     owner.Public,
+		VerifyKey: base64.StdEncoding.EncodeToString(verifyKey[:]),
+		SignKey:   base64.StdEncoding.EncodeToString(signKey[:]),
+		EpochKeys: make(map[int]keypair.KeyPair),
+	}
+	for _, member := range members {
+		g.Add(member)
+	}
+	groupKey, err := keypair.New()
+	if err != nil {
+		return
+	}
+	g.EpochKeys[g.Epoch] = groupKey
+	return
+}
+
+// Key returns the group key of the current epoch.
+func (g *Group) Key() keypair.KeyPair {
+	return g.EpochKeys[g.Epoch]
+}
+
+// Keys returns the group keys of every known epoch, to be used with Open.
+func (g *Group) Keys() (keys []keypair.KeyPair) {
+	keys = make([]keypair.KeyPair, 0, len(g.EpochKeys))
+	for epoch := g.Epoch; epoch >= 0; epoch-- {
+		if key, ok := g.EpochKeys[epoch]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// IsMember checks whether the public key belongs to a member.
+func (g *Group) IsMember(member string) bool {
+	for _, m := range g.Members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// Add will add a member to the group. The group key is not changed, so
+// the new member must be given the keys with Invite.
+func (g *Group) Add(member string) {
+	if g.IsMember(member) {
+		return
+	}
+	g.Members = append(g.Members, member)
+}
+
+// Remove will remove a member from the group and rekey the group so that
+// the removed member can not read any new messages.
+func (g *Group) Remove(member string) (err error) {
+	if !g.IsMember(member) {
+		err = fmt.Errorf("'%s' is not a member", member)
+		return
+	}
+	members := g.Members[:0]
+	for _, m := range g.Members {
+		if m != member {
+			members = append(members, m)
+		}
+	}
+	g.Members = members
+	return g.Rekey()
+}
+
+// Rekey generates a group key for the next epoch.
+func (g *Group) Rekey() (err error) {
+	groupKey, err := keypair.New()
+	if err != nil {
+		return
+	}
+	g.Epoch++
+	g.EpochKeys[g.Epoch] = groupKey
+	return
+}
+
+// Send will generate a new message for the group using the current group key.
+func (g *Group) Send(world keypair.KeyPair, sender keypair.KeyPair, msg []byte) (m Message, err error) {
+	return New(world, sender, []string{g.Key().Public}, msg)
+}
+
+// Distribute will generate a message for all members that contains the
+// group key of the current epoch. It should be sent after every rekey.
+func (g *Group) Distribute(world keypair.KeyPair, owner keypair.KeyPair) (m Message, err error) {
+	return g.keysMessage(world, owner, g.Members, 0)
+}
+
+// Invite will generate a message for a single member that contains the
+// group key of the current epoch and the keys of the history previous
+// epochs, so the member can read that window of past messages.
+func (g *Group) Invite(world keypair.KeyPair, owner keypair.KeyPair, member string, history int) (m Message, err error) {
+	if !g.IsMember(member) {
+		err = fmt.Errorf("'%s' is not a member", member)
+		return
+	}
+	return g.keysMessage(world, owner, []string{member}, history)
+}
+
+func (g *Group) keysMessage(world keypair.KeyPair, owner keypair.KeyPair, recipients []string, history int) (m Message, err error) {
+	if owner.Public != g.Owner || g.SignKey == "" {
+		err = fmt.Errorf("only the owner can distribute group keys")
+		return
+	}
+	signKeyBytes, err := base64.StdEncoding.DecodeString(g.SignKey)
+	if err != nil || len(signKeyBytes) != 64 {
+		err = fmt.Errorf("bad signing key")
+		return
+	}
+	var signKey [64]byte
+	copy(signKey[:], signKeyBytes)
+	gk := GroupKeys{
+		Kind:      groupKeysKind,
+		Name:      g.Name,
+		VerifyKey: g.VerifyKey,
+		Epoch:     g.Epoch,
+		Members:   g.Members,
+		Keys:      make(map[int]keypair.KeyPair),
+	}
+	for epoch := g.Epoch - history; epoch <= g.Epoch; epoch++ {
+		if key, ok := g.EpochKeys[epoch]; ok {
+			gk.Keys[epoch] = key
+		}
+	}
+	payload, err := json.Marshal(gk)
+	if err != nil {
+		return
+	}
+	return New(world, owner, recipients, sign.Sign(nil, payload, &signKey))
+}
+
+// JoinGroup will create a group from an opened message that contains
+// group keys, for members that do not know about the group yet. The
+// signing key of the owner is taken from the message, so later updates
+// have to be signed with the same key.
+func JoinGroup(openMsg OpenMessage) (g *Group, err error) {
+	g = &Group{
+		Owner:     openMsg.Sender,
+		Epoch:     -1,
+		EpochKeys: make(map[int]keypair.KeyPair),
+	}
+	if len(openMsg.MessageBytes) > sign.Overhead {
+		var gk GroupKeys
+		if json.Unmarshal(openMsg.MessageBytes[sign.Overhead:], &gk) == nil {
+			g.VerifyKey = gk.VerifyKey
+		}
+	}
+	err = g.Update(openMsg)
+	return
+}
+
+// Update will update the group from an opened message that contains
+// group keys signed by the owner.
+func (g *Group) Update(openMsg OpenMessage) (err error) {
+	if openMsg.Sender != g.Owner {
+		err = fmt.Errorf("group keys not sent by owner")
+		return
+	}
+	verifyKeyBytes, err := base64.StdEncoding.DecodeString(g.VerifyKey)
+	if err != nil || len(verifyKeyBytes) != 32 {
+		err = fmt.Errorf("bad verify key")
+		return
+	}
+	var verifyKey [32]byte
+	copy(verifyKey[:], verifyKeyBytes)
+	payload, ok := sign.Open(nil, openMsg.MessageBytes, &verifyKey)
+	if !ok {
+		err = fmt.Errorf("group keys are not signed by the owner")
+		return
+	}
+	var gk GroupKeys
+	err = json.Unmarshal(payload, &gk)
+	if err != nil {
+		err = errors.Wrap(err, "message does not contain group keys")
+		return
+	}
+	if gk.Kind != groupKeysKind {
+		err = fmt.Errorf("message does not contain group keys")
+		return
+	}
+	if g.Name != "" && g.Name != gk.Name {
+		err = fmt.Errorf("group keys are for '%s'", gk.Name)
+		return
+	}
+
+	for epoch, key := range gk.Keys {
+		// reload to make the key usable
+		key, err = keypair.New(key)
+		if err != nil {
+			err = errors.Wrap(err, "bad group key")
+			return
+		}
+		g.EpochKeys[epoch] = key
+	}
+	g.Name = gk.Name
+	if gk.Epoch > g.Epoch {
+		g.Epoch = gk.Epoch
+		g.Members = gk.Members
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package mail
+
+import (
+	"encoding/json"
+
+	"github.com/schollz/maildepot/keypair"
+)
+
+// Header is the encrypted list of recipients that every recipient can see.
+type Header struct {
+	// To is the list of public keys of the primary recipients
+	To []string `json:"to,omitempty"`
+	// Cc is the list of public keys of the copied recipients
+	Cc []string `json:"cc,omitempty"`
+	// Bcc is only set on the copy for a blind recipient and only
+	// contains that recipient
+	Bcc []string `json:"bcc,omitempty"`
+}
+
+// NewWithHeader will generate a message for the To and Cc recipients with
+// the header, and a separate copy for each of the Bcc recipients, so that
+// nobody learns who was sent a blind copy. The first message is for the
+// To and Cc recipients and is left out if there are none.
+func NewWithHeader(world keypair.KeyPair, sender keypair.KeyPair, h Header, msg []byte, opts ...Option) (msgs []Message, err error) {
+	visible := Header{To: h.To, Cc: h.Cc}
+	recipients := append(append([]string{}, h.To...), h.Cc...)
+	if len(recipients) > 0 {
+		var m Message
+		m, err = newWithHeader(world, sender, recipients, visible, msg, opts)
+		if err != nil {
+			return
+		}
+		msgs = append(msgs, m)
+	}
+
+	for _, bcc := range h.Bcc {
+		blind := visible
+		blind.Bcc = []string{bcc}
+		var m Message
+		m, err = newWithHeader(world, sender, []string{bcc}, blind, msg, opts)
+		if err != nil {
+			return
+		}
+		msgs = append(msgs, m)
+	}
+	return
+}
+
+func newWithHeader(world keypair.KeyPair, sender keypair.KeyPair, recipients []string, h Header, msg []byte, opts []Option) (m Message, err error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return
+	}
+	return New(world, sender, recipients, msg, append(opts, func(o *options) {
+		o.header = header
+	})...)
+}
+
+// ReplyAll returns the public keys to reply to everyone, which is the
+// sender and the visible recipients without me. Blind recipients are
+// never included.
+func (om OpenMessage) ReplyAll(me string) (recipients []string) {
+	seen := map[string]bool{me: true}
+	for _, r := range append(append([]string{om.Sender}, om.Header.To...), om.Header.Cc...) {
+		if !seen[r] {
+			seen[r] = true
+			recipients = append(recipients, r)
+		}
+	}
+	return
+}
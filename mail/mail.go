@@ -4,8 +4,8 @@ import (
 	crypto_rand "crypto/rand"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io"
+	"math/big"
 
 	"github.com/pkg/errors"
 	"github.com/schollz/maildepot/keypair"
@@ -20,6 +20,20 @@ type Message struct {
 	Recipients []string `json:"r"`
 	// Message is the payload encrypted by the message key
 	Message string `json:"m"`
+	// Version is the version of the payload envelope, zero is a raw payload
+	Version int `json:"v,omitempty"`
+	// World is the message ID encrypted by the world for itself
+	World string `json:"w,omitempty"`
+	// Stamp is a proof-of-work postage stamp bound to the message ID
+	Stamp string `json:"p,omitempty"`
+	// Time is when the message was sent, signed by a time authority
+	Time string `json:"t,omitempty"`
+	// TTL is the number of seconds after Time when the message expires
+	TTL int64 `json:"l,omitempty"`
+	// Suite is the name of the ciphers, empty for SuiteNaCl
+	Suite string `json:"c,omitempty"`
+	// Worlds are the wraps of the message key for other worlds
+	Worlds []WorldWraps `json:"x,omitempty"`
 }
 
 type OpenMessage struct {
@@ -29,6 +43,10 @@ type OpenMessage struct {
 	Recipients []keypair.KeyPair `json:"r"`
 	// Message is the payload
 	MessageBytes []byte `json:"m"`
+	// Header is the list of visible recipients, if the sender included it
+	Header Header `json:"h"`
+	// key is the message key, which is needed to rewrap the message
+	key [32]byte
 }
 
 func (m *Message) String() string {
@@ -47,70 +65,178 @@ func (m *Message) HashMessage() string {
 	return string(out)
 }
 
-// IsSameWorld checks to make sure that the message is from the same domain.
+// IsSameWorld checks to make sure that the message is from the same domain,
+// by checking that one of the world tags was made with the world key.
 func (m *Message) IsSameWorld(world keypair.KeyPair) bool {
 	if world.Public == "" {
 		return false
 	}
-	decodedSender, err := base64.StdEncoding.DecodeString(m.Sender)
+	shared, err := world.Precompute(world.Public)
 	if err != nil {
 		return false
 	}
-	_, err = world.Decrypt(decodedSender, world.Public)
+	for _, w := range m.allWorlds() {
+		if w.World != "" && m.isSameWorld(w.World, shared) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Message) isSameWorld(worldTag string, shared keypair.SharedKey) bool {
+	decodedWorld, err := base64.StdEncoding.DecodeString(worldTag)
 	if err != nil {
 		return false
 	}
-	return true
+	tag, err := shared.Decrypt(decodedWorld)
+	if err != nil {
+		return false
+	}
+	return string(tag) == m.ID()
 }
 
 // Open will open a message by trying each of my keys and
 // will return the key that opened the message and the
 // descrypted contents
-func (m Message) Open(world keypair.KeyPair, mykeys []keypair.KeyPair) (openMsg OpenMessage, err error) {
+func (m Message) Open(world keypair.KeyPair, mykeys []keypair.KeyPair, opts ...OpenOption) (openMsg OpenMessage, err error) {
+	keys, err := precompute(world, mykeys)
+	if err != nil {
+		return
+	}
+	return m.open(keys, newOpenOptions(opts))
+}
+
+// openKeys are my keys with their shared keys with the world.
+type openKeys struct {
+	// world is the shared key to check the world tag, if the world
+	// private key is known
+	world *keypair.SharedKey
+	keys  []openKey
+}
+
+type openKey struct {
+	keypair.KeyPair
+	shared keypair.SharedKey
+}
+
+// precompute computes the shared key of each of my keys with the world,
+// skipping keys without a private key.
+func precompute(world keypair.KeyPair, mykeys []keypair.KeyPair) (keys openKeys, err error) {
+	if _, err = keypair.NewFromPublic(world.Public); err != nil {
+		err = errors.Wrap(ErrWrongWorld, "bad world key")
+		return
+	}
+	// the world tag can only be checked by those with the world private key
+	if shared, err2 := world.Precompute(world.Public); err2 == nil {
+		keys.world = &shared
+	}
+	keys.keys = make([]openKey, 0, len(mykeys))
+	for _, key := range mykeys {
+		shared, err2 := key.Precompute(world.Public)
+		if err2 != nil {
+			continue
+		}
+		keys.keys = append(keys.keys, openKey{key, shared})
+	}
+	return
+}
+
+func (m Message) open(mykeys openKeys, o openOptions) (openMsg OpenMessage, err error) {
 	openMsg = OpenMessage{}
+	wraps, err := m.wrapsFor(mykeys.world)
+	if err != nil {
+		return
+	}
+	if !o.forceExpiry && m.IsExpired(o.authority, o.now()) {
+		err = ErrExpired
+		return
+	}
+	suite, err := suiteByName(m.Suite)
+	if err != nil {
+		return
+	}
+	if !o.acceptsSuite(m.Suite) {
+		err = errors.Wrapf(ErrSuiteNotAllowed, "suite '%s'", m.Suite)
+		return
+	}
 
 	// check if message is decodable
 	encryptedMessage, err := base64.StdEncoding.DecodeString(m.Message)
 	if err != nil {
-		err = errors.Wrap(err, "message is not decodable")
+		err = errors.Wrap(ErrMalformed, "message is not decodable")
 		return
 	}
 	// check if sender is decodable
 	encryptedSender, err := base64.StdEncoding.DecodeString(m.Sender)
 	if err != nil {
-		err = errors.Wrap(err, "sender is not decodable")
+		err = errors.Wrap(ErrMalformed, "sender is not decodable")
 		return
 	}
 
 	var secretKey []byte
-	for _, recipient := range m.Recipients {
+	for _, recipient := range wraps {
 		var decodedRecipient []byte
 		decodedRecipient, err = base64.StdEncoding.DecodeString(recipient)
-		for _, key := range mykeys {
-			if err != nil {
-				err = errors.Wrap(err, "malformed recipient")
-				return
-			}
-			secretKey, err = key.Decrypt(decodedRecipient, world.Public)
-			if err == nil {
-				openMsg.Recipients = append(openMsg.Recipients, key)
+		if err != nil {
+			err = errors.Wrap(ErrMalformed, "recipient is not decodable")
+			return
+		}
+		for _, key := range mykeys.keys {
+			recipientKey, err2 := suite.Unwrap(decodedRecipient, key.shared)
+			if err2 == nil {
+				secretKey = recipientKey
+				openMsg.Recipients = append(openMsg.Recipients, key.KeyPair)
 			}
 		}
 	}
-	if err != nil {
-		err = fmt.Errorf("could not find valid recipient")
+	if len(openMsg.Recipients) == 0 {
+		err = ErrNotForMe
+		return
+	}
+	if len(secretKey) != 32 {
+		err = errors.Wrap(ErrMalformed, "message key has wrong length")
 		return
 	}
 
 	var secretKey32 [32]byte
-	copy(secretKey32[:], secretKey[:32])
-	openMsg.MessageBytes, err = decrypt(encryptedMessage, secretKey32)
+	copy(secretKey32[:], secretKey)
+	openMsg.key = secretKey32
+	openMsg.MessageBytes, err = suite.Open(encryptedMessage, &secretKey32)
 	if err != nil {
 		err = errors.Wrap(err, "could not decrypt message with key")
 		return
 	}
+	switch m.Version {
+	case 0:
+		if m.Time != "" {
+			err = errors.Wrap(ErrTampered, "expiry does not match the message")
+			return
+		}
+	case EnvelopeVersion:
+		var env envelope
+		env, err = openEnvelope(openMsg.MessageBytes)
+		if err != nil {
+			return
+		}
+		// the expiry outside is only trusted if it was also encrypted
+		if env.time != m.Time || env.ttl != m.TTL {
+			err = errors.Wrap(ErrTampered, "expiry does not match the message")
+			return
+		}
+		openMsg.MessageBytes = env.body
+		if len(env.header) > 0 {
+			err = json.Unmarshal(env.header, &openMsg.Header)
+			if err != nil {
+				err = errors.Wrap(ErrMalformed, "header is not decodable")
+				return
+			}
+		}
+	default:
+		err = errors.Wrapf(ErrMalformed, "unsupported envelope version %d", m.Version)
+		return
+	}
 
-	senderBytes, err := decrypt(encryptedSender, secretKey32)
+	senderBytes, err := suite.Open(encryptedSender, &secretKey32)
 	if err != nil {
 		err = errors.Wrap(err, "could not decrypt sender with key")
 		return
@@ -121,43 +247,77 @@ func (m Message) Open(world keypair.KeyPair, mykeys []keypair.KeyPair) (openMsg
 }
 
 // New will generate a new message
-func New(world keypair.KeyPair, sender keypair.KeyPair, recipients []string, msg []byte) (m Message, err error) {
+func New(world keypair.KeyPair, sender keypair.KeyPair, recipients []string, msg []byte, opts ...Option) (m Message, err error) {
+	o := newOptions(opts)
+	suite, err := suiteByName(o.suite)
+	if err != nil {
+		return
+	}
+
+	plaintext, err := sealEnvelope(msg, o)
+	if err != nil {
+		return
+	}
+
 	// generate new secretKey for the message key
-	encrypted, secretKey, err := encryptWithRandomSecret(msg)
+	var secretKey [32]byte
+	if _, err = io.ReadFull(crypto_rand.Reader, secretKey[:]); err != nil {
+		return
+	}
+	encrypted, err := suite.Seal(plaintext, &secretKey)
 	if err != nil {
 		return
 	}
 
 	// encrypt the sender with the message key
-	encryptedSender, err := encryptWithSecret([]byte(sender.Public), secretKey)
+	encryptedSender, err := suite.Seal([]byte(sender.Public), &secretKey)
 	if err != nil {
 		return
 	}
 
 	m = Message{
-		Sender:     base64.StdEncoding.EncodeToString(encryptedSender),
-		Message:    base64.StdEncoding.EncodeToString(encrypted),
-		Recipients: make([]string, len(recipients)),
+		Sender:  base64.StdEncoding.EncodeToString(encryptedSender),
+		Message: base64.StdEncoding.EncodeToString(encrypted),
+		Version: EnvelopeVersion,
+		Time:    o.expiryTime,
+		TTL:     o.ttl,
+	}
+	if o.suite != SuiteNaCl {
+		m.Suite = o.suite
 	}
 
-	// encrypt each recipient with the message key
-	for i, recipientPublicKey := range recipients {
-		encrypted, err2 := world.Encrypt(secretKey[:], recipientPublicKey)
+	// encrypt the message key for each recipient and tag the message so
+	// that the world can recognize it
+	primary, err := m.wrap(world, suite, secretKey, recipients, o)
+	if err != nil {
+		return
+	}
+	m.World, m.Recipients = primary.World, primary.Recipients
+	for _, other := range o.worlds {
+		var w WorldWraps
+		w, err = m.wrap(other.world, suite, secretKey, other.recipients, o)
 		if err != nil {
-			err = errors.Wrap(err2, recipientPublicKey)
 			return
 		}
-		m.Recipients[i] = base64.StdEncoding.EncodeToString(encrypted)
+		m.Worlds = append(m.Worlds, w)
+	}
+
+	if o.stamp > 0 {
+		err = m.Mint(o.stamp)
 	}
 	return
 }
 
-func encryptWithRandomSecret(msg []byte) (encrypted []byte, secretKey [32]byte, err error) {
-	if _, err = io.ReadFull(crypto_rand.Reader, secretKey[:]); err != nil {
-		return
+// shuffle does a Fisher-Yates shuffle using crypto/rand.
+func shuffle(s []string) (err error) {
+	for i := len(s) - 1; i > 0; i-- {
+		var j *big.Int
+		j, err = crypto_rand.Int(crypto_rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return
+		}
+		s[i], s[j.Int64()] = s[j.Int64()], s[i]
 	}
-
-	encrypted, err = encryptWithSecret(msg, secretKey)
 	return
 }
 
@@ -180,11 +340,15 @@ func decrypt(encrypted []byte, secretKey [32]byte) (decrypted []byte, err error)
 	// encrypt the message. One way to achieve this is to store the nonce
 	// alongside the encrypted message. Above, we stored the nonce in the first
 	// 24 bytes of the encrypted text.
+	if len(encrypted) < 24+secretbox.Overhead {
+		err = errors.Wrap(ErrMalformed, "encrypted text is too short")
+		return
+	}
 	var decryptNonce [24]byte
 	copy(decryptNonce[:], encrypted[:24])
 	decrypted, ok := secretbox.Open(nil, encrypted[24:], &decryptNonce, &secretKey)
 	if !ok {
-		err = errors.New("decryption failed")
+		err = errors.Wrap(ErrTampered, "decryption failed")
 	}
 	return
 }
@@ -1,12 +1,22 @@
 package mail
 
 import (
+	"bytes"
+	"context"
+	crypto_rand "crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mr-tron/base58/base58"
 	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/timeauthority/authtime"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/sign"
 )
 
 func BenchmarkOpen(b *testing.B) {
@@ -60,7 +70,584 @@ func TestMulti(t *testing.T) {
 	msg, err := New(world, world, []string{bob.Public}, []byte("hello, world"))
 	assert.Nil(t, err)
 	fmt.Printf("msg: %+v\n", msg)
-	openMsg, err := msg.Open(world, []keypair.KeyPair{world})
+	_, err = msg.Open(world, []keypair.KeyPair{world})
+	assert.Equal(t, ErrNotForMe, err)
+	openMsg, err := msg.Open(world, []keypair.KeyPair{world, bob})
 	assert.Nil(t, err)
 	fmt.Printf("open msg: %+v\n", openMsg)
 }
+
+func TestGroup(t *testing.T) {
+	world, _ := keypair.New()
+	owner, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	jeff, _ := keypair.New()
+
+	g, err := NewGroup("friends", owner, []string{bob.Public, jane.Public})
+	assert.Nil(t, err)
+
+	// distribute the first key to everyone
+	keyMsg, err := g.Distribute(world, owner)
+	assert.Nil(t, err)
+	openMsg, err := keyMsg.Open(world, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	janeGroup, err := JoinGroup(openMsg)
+	assert.Nil(t, err)
+	assert.Equal(t, "friends", janeGroup.Name)
+	assert.Equal(t, 0, janeGroup.Epoch)
+
+	// one wrap for the whole group
+	msg, err := g.Send(world, bob, []byte("hello, friends"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msg.Recipients))
+	openMsg, err = msg.Open(world, append([]keypair.KeyPair{jane}, janeGroup.Keys()...))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello, friends"), openMsg.MessageBytes)
+
+	// removing bob rekeys the group
+	assert.Nil(t, g.Remove(bob.Public))
+	assert.Equal(t, 1, g.Epoch)
+	keyMsg, err = g.Distribute(world, owner)
+	assert.Nil(t, err)
+	_, err = keyMsg.Open(world, []keypair.KeyPair{bob})
+	assert.NotNil(t, err)
+	openMsg, err = keyMsg.Open(world, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	assert.Nil(t, janeGroup.Update(openMsg))
+	assert.Equal(t, 1, janeGroup.Epoch)
+	assert.Equal(t, 2, len(janeGroup.Keys()))
+
+	// jeff joins late with one epoch of history
+	g.Add(jeff.Public)
+	keyMsg, err = g.Invite(world, owner, jeff.Public, 1)
+	assert.Nil(t, err)
+	openMsg, err = keyMsg.Open(world, []keypair.KeyPair{jeff})
+	assert.Nil(t, err)
+	jeffGroup, err := JoinGroup(openMsg)
+	assert.Nil(t, err)
+	openMsg, err = msg.Open(world, jeffGroup.Keys())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello, friends"), openMsg.MessageBytes)
+
+	// keys from someone else than the owner are rejected
+	forged, _ := New(world, bob, []string{jane.Public}, []byte(`{"kind":"group-keys","name":"friends","epoch":5}`))
+	openMsg, _ = forged.Open(world, []keypair.KeyPair{jane})
+	assert.NotNil(t, janeGroup.Update(openMsg))
+	// even when the sender claims to be the owner, without the signature
+	claimed, _ := keypair.NewFromPublic(owner.Public)
+	other, _ := NewGroup("friends", owner, []string{jane.Public})
+	other.Epoch = 5
+	forged, err = other.Distribute(world, claimed)
+	assert.Nil(t, err)
+	openMsg, _ = forged.Open(world, []keypair.KeyPair{jane})
+	assert.Equal(t, owner.Public, openMsg.Sender)
+	assert.NotNil(t, janeGroup.Update(openMsg))
+	assert.Equal(t, 1, janeGroup.Epoch)
+}
+
+func TestChannel(t *testing.T) {
+	world, _ := keypair.New()
+	publisher, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+
+	c, err := NewChannel("news", time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, c.NeedsRotation())
+
+	request, err := RequestSubscription(world, bob, publisher.Public, "news")
+	assert.Nil(t, err)
+	openMsg, err := request.Open(world, []keypair.KeyPair{publisher})
+	assert.Nil(t, err)
+	sub, err := c.Subscribe(world, publisher, openMsg)
+	assert.Nil(t, err)
+	openMsg, err = sub.Open(world, []keypair.KeyPair{bob})
+	assert.Nil(t, err)
+	bobChannel, err := JoinChannel(openMsg)
+	assert.Nil(t, err)
+	assert.Equal(t, "", bobChannel.SignKey)
+
+	// nobody can subscribe someone else
+	fake, _ := json.Marshal(channelSubscription{Kind: channelSubscribeKind, Name: "news", Subscriber: jane.Public, Proof: []byte("proof")})
+	request, _ = New(world, bob, []string{publisher.Public}, fake)
+	openMsg, _ = request.Open(world, []keypair.KeyPair{publisher})
+	_, err = c.Subscribe(world, publisher, openMsg)
+	assert.NotNil(t, err)
+	proof, _ := bob.Encrypt([]byte("subscribe:news"), publisher.Public)
+	fake, _ = json.Marshal(channelSubscription{Kind: channelSubscribeKind, Name: "news", Subscriber: jane.Public, Proof: proof})
+	request, _ = New(world, bob, []string{publisher.Public}, fake)
+	openMsg, _ = request.Open(world, []keypair.KeyPair{publisher})
+	_, err = c.Subscribe(world, publisher, openMsg)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{bob.Public}, c.Members)
+
+	request, _ = RequestSubscription(world, jane, publisher.Public, "news")
+	openMsg, _ = request.Open(world, []keypair.KeyPair{publisher})
+	sub, err = c.Subscribe(world, publisher, openMsg)
+	assert.Nil(t, err)
+	openMsg, _ = sub.Open(world, []keypair.KeyPair{jane})
+	janeChannel, err := JoinChannel(openMsg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{bob.Public, jane.Public}, c.Members)
+
+	msg, err := c.Post(world, publisher, []byte("breaking news"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msg.Recipients))
+	post, err := bobChannel.Open(world, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("breaking news"), post.MessageBytes)
+
+	post, err = janeChannel.Open(world, msg)
+	assert.Nil(t, err)
+
+	// the new key is only sent to the members
+	c.Unsubscribe(jane.Public)
+	rotation, err := c.Rotate(world, publisher)
+	assert.Nil(t, err)
+	msg, err = c.Post(world, publisher, []byte("more news"))
+	assert.Nil(t, err)
+	_, err = bobChannel.Open(world, msg)
+	assert.NotNil(t, err)
+	_, err = bobChannel.Open(world, rotation)
+	assert.NotNil(t, err)
+	_, err = janeChannel.Open(world, rotation, jane)
+	assert.NotNil(t, err)
+	post, err = bobChannel.Open(world, rotation, bob)
+	assert.Nil(t, err)
+	assert.True(t, post.Rotation)
+	assert.Equal(t, 1, bobChannel.Epoch)
+	post, err = bobChannel.Open(world, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("more news"), post.MessageBytes)
+
+	// subscribers can not post
+	_, err = bobChannel.Post(world, bob, []byte("fake news"))
+	assert.NotNil(t, err)
+	forged, _ := New(world, bob, []string{bobChannel.Key().Public}, []byte("fake news"))
+	_, err = bobChannel.Open(world, forged)
+	assert.NotNil(t, err)
+}
+
+func TestPadding(t *testing.T) {
+	assert.Equal(t, 8, PadPowerOfTwo.size(5))
+	assert.Equal(t, 1024, PadPowerOfTwo.size(1000))
+	assert.Equal(t, 1024, PadPowerOfTwo.size(1024))
+	assert.Equal(t, 1000, PadNone.size(1000))
+	assert.Equal(t, 1024, PadPadme.size(1000))
+	assert.Equal(t, 1088, PadPadme.size(1030))
+	assert.Equal(t, 1024, PadPadme.size(1024))
+	assert.Equal(t, 10, PadPadme.size(9))
+
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	other, err := New(world, bob, []string{bob.Public}, []byte("hello, world, again!"), WithPadding(PadPowerOfTwo))
+	assert.Nil(t, err)
+	long, err := New(world, bob, []string{bob.Public}, []byte("hello, world"), WithPadding(PadPowerOfTwo))
+	assert.Nil(t, err)
+	assert.Equal(t, len(other.Message), len(long.Message))
+	openMsg, err := long.Open(world, []keypair.KeyPair{bob})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello, world"), openMsg.MessageBytes)
+}
+
+func TestDummyRecipients(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	msg, err := New(world, bob, []string{jane.Public}, []byte("hello, world"), WithDummyRecipients(3))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(msg.Recipients))
+	for _, r := range msg.Recipients {
+		assert.Equal(t, len(msg.Recipients[0]), len(r))
+	}
+	openMsg, err := msg.Open(world, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(openMsg.Recipients))
+	assert.Equal(t, []byte("hello, world"), openMsg.MessageBytes)
+
+	msg, err = New(world, bob, []string{jane.Public}, []byte("hello, world"), WithDummyRecipients(-1))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msg.Recipients))
+}
+
+func TestCompression(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	payload := []byte(strings.Repeat(`{"hello":"world"},`, 100))
+	plain, err := New(world, bob, []string{bob.Public}, payload)
+	assert.Nil(t, err)
+	for _, c := range []Compression{CompressDeflate, CompressZstd} {
+		msg, err := New(world, bob, []string{bob.Public}, payload, WithCompression(c), WithPadding(PadPadme))
+		assert.Nil(t, err)
+		assert.True(t, len(msg.Message) < len(plain.Message))
+		openMsg, err := msg.Open(world, []keypair.KeyPair{bob})
+		assert.Nil(t, err)
+		assert.Equal(t, payload, openMsg.MessageBytes)
+	}
+
+	// refuse to decompress bombs
+	defer func(max int64) { MaxDecompressedSize = max }(MaxDecompressedSize)
+	MaxDecompressedSize = 100
+	msg, err := New(world, bob, []string{bob.Public}, payload, WithCompression(CompressZstd))
+	assert.Nil(t, err)
+	_, err = msg.Open(world, []keypair.KeyPair{bob})
+	assert.NotNil(t, err)
+}
+
+func TestStamp(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	msg, err := New(world, bob, []string{bob.Public}, []byte("hello, world"), WithStamp(12))
+	assert.Nil(t, err)
+	assert.Nil(t, msg.CheckStamp(12))
+	assert.Nil(t, msg.CheckStamp(0))
+
+	// the stamp is bound to the message
+	other, _ := New(world, bob, []string{bob.Public}, []byte("hello, world"))
+	assert.NotNil(t, other.CheckStamp(8))
+	other.Stamp = msg.Stamp
+	assert.NotNil(t, other.CheckStamp(12))
+
+	// and to its recipients
+	jane, _ := keypair.New()
+	other, _ = New(world, bob, []string{bob.Public, jane.Public}, []byte("hello, world"), WithStamp(12))
+	assert.Nil(t, other.CheckStamp(12))
+	other.Recipients = other.Recipients[:1]
+	assert.NotNil(t, other.CheckStamp(12))
+	assert.NotNil(t, other.Mint(MaxStampBits+1))
+	_, err = New(world, bob, []string{bob.Public}, []byte("hello, world"), WithStamp(MaxStampBits+1))
+	assert.NotNil(t, err)
+
+	d := Difficulty{Base: 10, PerSizeDoubling: 1, PerRecipientDoubling: 2}
+	assert.Equal(t, 10, d.Bits(msg))
+	msg.Recipients = make([]string, 8)
+	msg.Message = strings.Repeat("a", 4096)
+	assert.Equal(t, 10+3+6, d.Bits(msg))
+}
+
+func TestExpiry(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	authorityPublic, authorityPrivate, _ := sign.GenerateKey(crypto_rand.Reader)
+	authority := base58.FastBase58Encoding(authorityPublic[:])
+
+	now := authtime.Sign(time.Now(), authorityPrivate)
+	msg, err := New(world, bob, []string{bob.Public}, []byte("hello, world"), WithExpiry(now, time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, msg.IsExpired(authority, time.Now()))
+	assert.True(t, msg.IsExpired(authority, time.Now().Add(2*time.Hour)))
+	_, err = msg.Open(world, []keypair.KeyPair{bob}, WithTimeAuthority(authority))
+	assert.Nil(t, err)
+
+	old := authtime.Sign(time.Now().Add(-2*time.Hour), authorityPrivate)
+	msg, err = New(world, bob, []string{bob.Public}, []byte("hello, world"), WithExpiry(old, time.Hour))
+	assert.Nil(t, err)
+	_, err = msg.Open(world, []keypair.KeyPair{bob}, WithTimeAuthority(authority))
+	assert.Equal(t, ErrExpired, err)
+	openMsg, err := msg.Open(world, []keypair.KeyPair{bob}, ForceExpired())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello, world"), openMsg.MessageBytes)
+
+	// the relay can not extend the expiry
+	msg.Time = now
+	_, err = msg.Open(world, []keypair.KeyPair{bob})
+	assert.NotNil(t, err)
+
+	// a time from another authority is expired
+	_, otherPrivate, _ := sign.GenerateKey(crypto_rand.Reader)
+	msg.Time = authtime.Sign(time.Now(), otherPrivate)
+	assert.True(t, msg.IsExpired(authority, time.Now()))
+
+	// but a stored value is only deleted when its expiry can be checked
+	stored, _ := json.Marshal(msg)
+	assert.False(t, Expired(authority, time.Now())(stored))
+	msg.Time = old
+	stored, _ = json.Marshal(msg)
+	assert.True(t, Expired(authority, time.Now())(stored))
+	assert.False(t, Expired(authority, time.Now())([]byte(`"not a message"`)))
+}
+
+func TestWorld(t *testing.T) {
+	world, _ := keypair.New()
+	other, _ := keypair.New()
+	bob, _ := keypair.New()
+	msg, err := New(world, bob, []string{bob.Public}, []byte("hello, world"))
+	assert.Nil(t, err)
+	assert.True(t, msg.IsSameWorld(world))
+	assert.False(t, msg.IsSameWorld(other))
+	_, err = msg.Open(other, []keypair.KeyPair{bob})
+	assert.Equal(t, ErrWrongWorld, err)
+	_, err = msg.Open(keypair.KeyPair{}, []keypair.KeyPair{bob})
+	assert.True(t, errors.Is(err, ErrWrongWorld))
+}
+
+func TestMalformed(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	good, _ := New(world, bob, []string{bob.Public}, []byte("hello, world"))
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+
+	for name, tc := range map[string]struct {
+		change func(m *Message)
+		err    error
+	}{
+		"message not base64":   {func(m *Message) { m.Message = "!" }, ErrMalformed},
+		"sender not base64":    {func(m *Message) { m.Sender = "!" }, ErrMalformed},
+		"recipient not base64": {func(m *Message) { m.Recipients[0] = "!" }, ErrMalformed},
+		"short recipient":      {func(m *Message) { m.Recipients[0] = short }, ErrNotForMe},
+		"no recipients":        {func(m *Message) { m.Recipients = nil }, ErrNotForMe},
+		"short message":        {func(m *Message) { m.Message = short }, ErrMalformed},
+		"short sender":         {func(m *Message) { m.Sender = short }, ErrMalformed},
+		"flipped message":      {func(m *Message) { m.Message = flip(m.Message) }, ErrTampered},
+		"flipped sender":       {func(m *Message) { m.Sender = flip(m.Sender) }, ErrTampered},
+		"unknown version":      {func(m *Message) { m.Version = 99 }, ErrMalformed},
+	} {
+		m := good
+		m.Recipients = append([]string{}, good.Recipients...)
+		tc.change(&m)
+		m.World = ""
+		_, err := m.Open(world, []keypair.KeyPair{bob})
+		assert.True(t, errors.Is(err, tc.err), "%s: %v", name, err)
+	}
+}
+
+func flip(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	b[len(b)-1] ^= 1
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func FuzzOpen(f *testing.F) {
+	world, _ := keypair.NewDeterministic("world")
+	bob, _ := keypair.NewDeterministic("bob")
+	msg, _ := New(world, bob, []string{bob.Public}, []byte("hello, world"), WithCompression(CompressZstd))
+	f.Add([]byte(msg.String()))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Message
+		if json.Unmarshal(data, &m) != nil {
+			return
+		}
+		m.Open(world, []keypair.KeyPair{bob}, ForceExpired())
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	world, _ := keypair.NewDeterministic("world")
+	bob, _ := keypair.NewDeterministic("bob")
+	f.Add([]byte("hello, world"), 0, byte(0))
+	f.Add([]byte{}, 1, byte(2))
+	f.Fuzz(func(t *testing.T, payload []byte, padding int, compression byte) {
+		msg, err := New(world, bob, []string{bob.Public}, payload,
+			WithPadding(Padding(padding%3)), WithCompression(Compression(compression%3)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		openMsg, err := msg.Open(world, []keypair.KeyPair{bob})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, openMsg.MessageBytes) {
+			t.Fatalf("got %x, expected %x", openMsg.MessageBytes, payload)
+		}
+	})
+}
+
+func TestOpenAll(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	messages := Messages{}
+	for i := 0; i < 20; i++ {
+		recipient := bob.Public
+		if i%2 == 1 {
+			recipient = jane.Public
+		}
+		msg, _ := New(world, bob, []string{recipient}, []byte(fmt.Sprintf("message %d", i)))
+		messages = append(messages, msg)
+	}
+	messages[4].Recipients[0] = "!"
+
+	results, err := OpenAll(context.Background(), world, []keypair.KeyPair{bob}, &messages, WithWorkers(4))
+	assert.Nil(t, err)
+	opened, notForMe, malformed := 0, 0, 0
+	for r := range results {
+		switch {
+		case r.Err == nil:
+			assert.Equal(t, fmt.Sprintf("message %d", r.Index), string(r.OpenMessage.MessageBytes))
+			opened++
+		case errors.Is(r.Err, ErrNotForMe):
+			notForMe++
+		case errors.Is(r.Err, ErrMalformed):
+			assert.Equal(t, 4, r.Index)
+			malformed++
+		}
+	}
+	assert.Equal(t, 9, opened)
+	assert.Equal(t, 10, notForMe)
+	assert.Equal(t, 1, malformed)
+
+	// cancelling stops the batch early
+	msg, _ := New(world, bob, []string{bob.Public}, []byte("hello, world"))
+	messages = Messages{}
+	for i := 0; i < 100; i++ {
+		messages = append(messages, msg)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, err = OpenAll(ctx, world, []keypair.KeyPair{bob}, &messages, WithWorkers(1))
+	assert.Nil(t, err)
+	<-results
+	cancel()
+	n := 1
+	for range results {
+		n++
+	}
+	assert.Less(t, n, 100)
+}
+
+func BenchmarkOpenAll(b *testing.B) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	msg, _ := New(world, bob, []string{jane.Public}, []byte("hello, world"))
+	all := make(Messages, 1000)
+	for i := range all {
+		all[i] = msg
+	}
+	for n := 0; n < b.N; n++ {
+		messages := append(Messages{}, all...)
+		results, _ := OpenAll(context.Background(), world, []keypair.KeyPair{bob}, &messages)
+		for range results {
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	jeff, _ := keypair.New()
+	bill, _ := keypair.New()
+
+	msgs, err := NewWithHeader(world, bob, Header{
+		To:  []string{jane.Public},
+		Cc:  []string{jeff.Public},
+		Bcc: []string{bill.Public},
+	}, []byte("hello, world"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, 2, len(msgs[0].Recipients))
+	assert.Equal(t, 1, len(msgs[1].Recipients))
+
+	openMsg, err := msgs[0].Open(world, []keypair.KeyPair{jeff})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{jane.Public}, openMsg.Header.To)
+	assert.Equal(t, []string{jeff.Public}, openMsg.Header.Cc)
+	assert.Empty(t, openMsg.Header.Bcc)
+	assert.Equal(t, []string{bob.Public, jane.Public}, openMsg.ReplyAll(jeff.Public))
+
+	// the blind recipient can only open their own copy
+	_, err = msgs[0].Open(world, []keypair.KeyPair{bill})
+	assert.Equal(t, ErrNotForMe, err)
+	openMsg, err = msgs[1].Open(world, []keypair.KeyPair{bill})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{bill.Public}, openMsg.Header.Bcc)
+	assert.Equal(t, []byte("hello, world"), openMsg.MessageBytes)
+	assert.Equal(t, []string{bob.Public, jane.Public, jeff.Public}, openMsg.ReplyAll(bill.Public))
+}
+
+func TestSuite(t *testing.T) {
+	world, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+
+	for _, suite := range Suites() {
+		msg, err := New(world, bob, []string{jane.Public}, []byte("hello, world"), WithSuite(suite), WithDummyRecipients(2))
+		assert.Nil(t, err)
+		openMsg, err := msg.Open(world, []keypair.KeyPair{jane})
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello, world"), openMsg.MessageBytes)
+		assert.Equal(t, bob.Public, openMsg.Sender)
+	}
+
+	// the nacl suite is the same as no suite
+	msg, err := New(world, bob, []string{jane.Public}, []byte("hello, world"), WithSuite(SuiteNaCl))
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg.Suite)
+	_, err = New(world, bob, []string{jane.Public}, []byte("hello, world"), WithSuite("rot13"))
+	assert.True(t, errors.Is(err, ErrMalformed))
+
+	// the policy decides which suites open
+	msg, err = New(world, bob, []string{jane.Public}, []byte("hello, world"), WithSuite(SuiteXChaCha20Poly1305))
+	assert.Nil(t, err)
+	_, err = msg.Open(world, []keypair.KeyPair{jane}, WithSuites(SuiteNaCl))
+	assert.True(t, errors.Is(err, ErrSuiteNotAllowed))
+	_, err = msg.Open(world, []keypair.KeyPair{jane}, WithSuites(SuiteXChaCha20Poly1305))
+	assert.Nil(t, err)
+
+	// changing the suite changes the ID, so the world tag no longer matches
+	id := msg.ID()
+	msg.Suite = ""
+	assert.NotEqual(t, id, msg.ID())
+	_, err = msg.Open(world, []keypair.KeyPair{jane})
+	assert.Equal(t, ErrWrongWorld, err)
+	// without the world private key the unknown suite is found
+	msg.Suite = "rot13"
+	worldPublic, _ := keypair.NewFromPublic(world.Public)
+	_, err = msg.Open(worldPublic, []keypair.KeyPair{jane})
+	assert.True(t, errors.Is(err, ErrMalformed))
+}
+
+func TestWorlds(t *testing.T) {
+	world1, _ := keypair.New()
+	world2, _ := keypair.New()
+	world3, _ := keypair.New()
+	bob, _ := keypair.New()
+	jane, _ := keypair.New()
+	jeff, _ := keypair.New()
+
+	msg, err := New(world1, bob, []string{jane.Public}, []byte("hello, world"), WithWorld(world2, jeff.Public), WithStamp(4))
+	assert.Nil(t, err)
+	assert.True(t, msg.IsSameWorld(world1))
+	assert.True(t, msg.IsSameWorld(world2))
+	assert.False(t, msg.IsSameWorld(world3))
+	// the recipients of the second world count towards the difficulty
+	d := Difficulty{PerRecipientDoubling: 2}
+	assert.Equal(t, 2, d.Bits(msg))
+	_, err = msg.Open(world3, []keypair.KeyPair{jane})
+	assert.Equal(t, ErrWrongWorld, err)
+
+	openMsg, err := msg.Open(world1, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello, world"), openMsg.MessageBytes)
+	// jeff is only a recipient in the second world
+	_, err = msg.Open(world1, []keypair.KeyPair{jeff})
+	assert.Equal(t, ErrNotForMe, err)
+	openMsg, err = msg.Open(world2, []keypair.KeyPair{jeff})
+	assert.Nil(t, err)
+	assert.Equal(t, bob.Public, openMsg.Sender)
+
+	// a bridge in the second world moves it into the third
+	bridged, err := msg.Rewrap(openMsg, world3, []string{jane.Public})
+	assert.Nil(t, err)
+	assert.Equal(t, msg.ID(), bridged.ID())
+	assert.NotNil(t, bridged.CheckStamp(4))
+	bridged, err = msg.Rewrap(openMsg, world3, []string{jane.Public}, WithStamp(4))
+	assert.Nil(t, err)
+	assert.Nil(t, bridged.CheckStamp(4))
+	assert.Empty(t, bridged.Worlds)
+	assert.False(t, bridged.IsSameWorld(world1))
+	openMsg, err = bridged.Open(world3, []keypair.KeyPair{jane})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello, world"), openMsg.MessageBytes)
+	_, err = bridged.Open(world3, []keypair.KeyPair{jeff})
+	assert.Equal(t, ErrNotForMe, err)
+
+	// only opened messages can be rewrapped
+	_, err = msg.Rewrap(OpenMessage{}, world3, []string{jane.Public})
+	assert.NotNil(t, err)
+	other, _ := New(world1, bob, []string{jane.Public}, []byte("hello, world"))
+	_, err = other.Rewrap(openMsg, world3, []string{jane.Public})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,97 @@
+package mail
+
+import (
+	"context"
+	"sync"
+
+	"github.com/schollz/maildepot/keypair"
+)
+
+// MessageIterator gives messages one at a time, for example from a relay.
+type MessageIterator interface {
+	// Next returns the next message, or false when there are no more
+	Next() (m Message, ok bool)
+}
+
+// Messages is a MessageIterator over a slice of messages.
+type Messages []Message
+
+// Next returns the next message in the slice.
+func (ms *Messages) Next() (m Message, ok bool) {
+	if len(*ms) == 0 {
+		return
+	}
+	m, *ms = (*ms)[0], (*ms)[1:]
+	return m, true
+}
+
+// OpenResult is the outcome of opening one message with OpenAll.
+type OpenResult struct {
+	// Index is the position of the message in the iterator
+	Index int
+	// Message is the message that was opened
+	Message Message
+	// OpenMessage is the opened message if there was no error
+	OpenMessage OpenMessage
+	// Err is why the message could not be opened, ErrNotForMe for
+	// messages that are not for any of the keys
+	Err error
+}
+
+// OpenAll will open every message from the iterator in parallel and
+// streams the results in the order they finish. A message that fails to
+// open does not stop the others. The channel is closed when all of the
+// messages are done or when the context is cancelled.
+func OpenAll(ctx context.Context, world keypair.KeyPair, mykeys []keypair.KeyPair, iter MessageIterator, opts ...OpenOption) (results <-chan OpenResult, err error) {
+	// the shared keys are computed once for the whole batch
+	keys, err := precompute(world, mykeys)
+	if err != nil {
+		return
+	}
+	o := newOpenOptions(opts)
+
+	type job struct {
+		index int
+		m     Message
+	}
+	jobs := make(chan job)
+	out := make(chan OpenResult)
+	results = out
+
+	go func() {
+		defer close(jobs)
+		for i := 0; ; i++ {
+			m, ok := iter.Next()
+			if !ok {
+				return
+			}
+			select {
+			case jobs <- job{i, m}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < o.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				r := OpenResult{Index: j.index, Message: j.m}
+				r.OpenMessage, r.Err = j.m.open(keys, o)
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return
+}
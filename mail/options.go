@@ -0,0 +1,171 @@
+package mail
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/schollz/maildepot/keypair"
+)
+
+// Option changes how New generates a message.
+type Option func(*options)
+
+type options struct {
+	padding         Padding
+	compression     Compression
+	dummyRecipients int
+	shuffle         bool
+	stamp           int
+	expiryTime      string
+	ttl             int64
+	header          []byte
+	suite           string
+	worlds          []otherWorld
+}
+
+// otherWorld is a world with recipients to wrap the message key for.
+type otherWorld struct {
+	world      keypair.KeyPair
+	recipients []string
+}
+
+func newOptions(opts []Option) (o options) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// WithPadding pads the payload before encryption so that the length of
+// the encrypted message only reveals the padding bucket.
+func WithPadding(padding Padding) Option {
+	return func(o *options) {
+		o.padding = padding
+	}
+}
+
+// WithCompression compresses the payload before it is padded and
+// encrypted. The payload is left uncompressed if it does not get smaller.
+func WithCompression(compression Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithDummyRecipients adds n random recipient slots which nobody can
+// open, so that relays can not count the real recipients. The recipients
+// are shuffled so the dummies are not recognizable by their position.
+// A negative n adds none.
+func WithDummyRecipients(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			n = 0
+		}
+		o.dummyRecipients = n
+		o.shuffle = true
+	}
+}
+
+// WithShuffledRecipients shuffles the order of the recipients.
+func WithShuffledRecipients() Option {
+	return func(o *options) {
+		o.shuffle = true
+	}
+}
+
+// WithStamp mints a postage stamp with the given number of bits of work.
+func WithStamp(difficulty int) Option {
+	return func(o *options) {
+		o.stamp = difficulty
+	}
+}
+
+// WithExpiry makes the message expire ttl after the authenticated time,
+// which is a timestamp signed by a time authority.
+func WithExpiry(authenticatedTime string, ttl time.Duration) Option {
+	return func(o *options) {
+		o.expiryTime = authenticatedTime
+		o.ttl = int64(ttl / time.Second)
+	}
+}
+
+// WithSuite encrypts the message with a registered suite.
+func WithSuite(name string) Option {
+	return func(o *options) {
+		o.suite = name
+	}
+}
+
+// WithWorld also wraps the message key for recipients in another world,
+// so one message can be opened in several worlds.
+func WithWorld(world keypair.KeyPair, recipients ...string) Option {
+	return func(o *options) {
+		o.worlds = append(o.worlds, otherWorld{world, recipients})
+	}
+}
+
+// OpenOption changes how Open opens a message.
+type OpenOption func(*openOptions)
+
+type openOptions struct {
+	authority   string
+	forceExpiry bool
+	now         func() time.Time
+	workers     int
+	// suites are the acceptable suites, or nil to accept all of them
+	suites map[string]bool
+}
+
+func newOpenOptions(opts []OpenOption) (o openOptions) {
+	o.now = time.Now
+	o.workers = runtime.NumCPU()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// WithTimeAuthority checks the time of expiring messages against the
+// base58 public key of the time authority.
+func WithTimeAuthority(publicKey string) OpenOption {
+	return func(o *openOptions) {
+		o.authority = publicKey
+	}
+}
+
+// WithSuites only opens messages that use one of the suites.
+func WithSuites(names ...string) OpenOption {
+	return func(o *openOptions) {
+		o.suites = make(map[string]bool)
+		for _, name := range names {
+			o.suites[name] = true
+		}
+	}
+}
+
+// acceptsSuite checks the suite of a message against the policy.
+func (o openOptions) acceptsSuite(name string) bool {
+	if o.suites == nil {
+		return true
+	}
+	if name == "" {
+		name = SuiteNaCl
+	}
+	return o.suites[name]
+}
+
+// ForceExpired opens messages even if they have expired.
+func ForceExpired() OpenOption {
+	return func(o *openOptions) {
+		o.forceExpiry = true
+	}
+}
+
+// WithWorkers sets the number of messages that OpenAll opens at once.
+func WithWorkers(n int) OpenOption {
+	return func(o *openOptions) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
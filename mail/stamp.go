@@ -0,0 +1,137 @@
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// stampVersion is the version of the postage stamp format.
+const stampVersion = "2"
+
+// MaxStampBits is the most bits of work a stamp can have.
+const MaxStampBits = 256
+
+// Difficulty is a policy that decides how many bits of work a stamp needs.
+// The work grows with the size of the message and the number of
+// recipients so that bulk mail costs more to send.
+type Difficulty struct {
+	// Base is the number of bits required for every message
+	Base int `json:"base"`
+	// PerSizeDoubling is added for every doubling of the message above 1 kB
+	PerSizeDoubling int `json:"per_size_doubling"`
+	// PerRecipientDoubling is added for every doubling of the recipients
+	PerRecipientDoubling int `json:"per_recipient_doubling"`
+}
+
+// Bits returns the number of bits required for the message. The
+// recipients of every world count.
+func (d Difficulty) Bits(m Message) (n int) {
+	n = d.Base
+	if kb := len(m.Message) >> 10; kb > 0 {
+		n += d.PerSizeDoubling * bits.Len(uint(kb))
+	}
+	recipients := 0
+	for _, w := range m.allWorlds() {
+		recipients += len(w.Recipients)
+	}
+	if recipients > 1 {
+		n += d.PerRecipientDoubling * (bits.Len(uint(recipients)) - 1)
+	}
+	return
+}
+
+// ID returns an identifier of the message. It only covers the encrypted
+// sender, payload, expiry and suite, so it stays the same if the message
+// key is wrapped for other recipients.
+func (m *Message) ID() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%s:%s", m.Version, m.Sender, m.Message)
+	if m.Time != "" {
+		fmt.Fprintf(h, ":%s:%d", m.Time, m.TTL)
+	}
+	if m.Suite != "" {
+		fmt.Fprintf(h, ":%s", m.Suite)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Digest returns a hash of the whole message, with the wraps and the
+// stamp, which tells apart copies of a message that have the same ID.
+func (m *Message) Digest() string {
+	h := sha256.Sum256([]byte(m.String()))
+	return hex.EncodeToString(h[:])
+}
+
+// stampID returns what the stamp is bound to. Unlike the ID it covers
+// the wraps of every world, so a stamp can not be moved to a copy of the
+// message with other recipients.
+func (m *Message) stampID() string {
+	h := sha256.New()
+	h.Write([]byte(m.ID()))
+	for _, w := range m.allWorlds() {
+		fmt.Fprintf(h, ";%s", w.World)
+		for _, recipient := range w.Recipients {
+			fmt.Fprintf(h, ":%s", recipient)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Mint will compute a hashcash style postage stamp for the message with
+// the given number of leading zero bits. The recipients have to be final.
+func (m *Message) Mint(difficulty int) (err error) {
+	if difficulty > MaxStampBits {
+		err = fmt.Errorf("stamp can not have more than %d bits of work", MaxStampBits)
+		return
+	}
+	id := m.stampID()
+	for counter := uint64(0); ; counter++ {
+		if stampBits(id, counter) >= difficulty {
+			m.Stamp = strings.Join([]string{stampVersion, strconv.Itoa(difficulty), strconv.FormatUint(counter, 16)}, ":")
+			return
+		}
+	}
+}
+
+// CheckStamp will make sure that the message has a stamp with at least
+// the given number of leading zero bits.
+func (m *Message) CheckStamp(difficulty int) (err error) {
+	if difficulty <= 0 {
+		return
+	}
+	fields := strings.Split(m.Stamp, ":")
+	if len(fields) != 3 || fields[0] != stampVersion {
+		err = fmt.Errorf("missing or malformed stamp")
+		return
+	}
+	counter, err := strconv.ParseUint(fields[2], 16, 64)
+	if err != nil {
+		err = fmt.Errorf("malformed stamp counter")
+		return
+	}
+	if stampBits(m.stampID(), counter) < difficulty {
+		err = fmt.Errorf("stamp does not have %d bits of work", difficulty)
+	}
+	return
+}
+
+// stampBits returns the number of leading zero bits of the stamp hash.
+func stampBits(id string, counter uint64) (n int) {
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	h := sha256.New()
+	h.Write([]byte(id))
+	h.Write(c[:])
+	for _, b := range h.Sum(nil) {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return
+}
@@ -0,0 +1,157 @@
+package mail
+
+import (
+	crypto_rand "crypto/rand"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/maildepot/keypair"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Names of the built in suites.
+const (
+	// SuiteNaCl is XSalsa20-Poly1305 secretbox for the payload and
+	// curve25519 box for the key wraps. Messages without a suite use it.
+	SuiteNaCl = "nacl"
+	// SuiteXChaCha20Poly1305 is XChaCha20-Poly1305 for the payload and for
+	// the key wraps, with the wrap key derived by HKDF-SHA256 from the
+	// curve25519 shared key.
+	SuiteXChaCha20Poly1305 = "xchacha20poly1305-hkdf"
+)
+
+// Suite is the set of ciphers that a message is encrypted with.
+type Suite interface {
+	// Seal encrypts the payload or the sender with the message key
+	Seal(plaintext []byte, key *[32]byte) (ciphertext []byte, err error)
+	// Open decrypts what Seal encrypted
+	Open(ciphertext []byte, key *[32]byte) (plaintext []byte, err error)
+	// Wrap encrypts the message key with the shared key of the world and
+	// a recipient
+	Wrap(messageKey []byte, shared keypair.SharedKey) (wrapped []byte, err error)
+	// Unwrap decrypts what Wrap encrypted
+	Unwrap(wrapped []byte, shared keypair.SharedKey) (messageKey []byte, err error)
+	// Overhead is the number of bytes that Seal and Wrap add
+	Overhead() int
+}
+
+var suites = struct {
+	sync.RWMutex
+	m map[string]Suite
+}{m: map[string]Suite{
+	SuiteNaCl:              naclSuite{},
+	SuiteXChaCha20Poly1305: xchachaSuite{},
+}}
+
+// RegisterSuite will make a suite available to New and Open by name.
+func RegisterSuite(name string, suite Suite) {
+	suites.Lock()
+	defer suites.Unlock()
+	suites.m[name] = suite
+}
+
+// Suites returns the names of the registered suites.
+func Suites() (names []string) {
+	suites.RLock()
+	defer suites.RUnlock()
+	for name := range suites.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// suiteByName returns a registered suite, where no name is SuiteNaCl.
+func suiteByName(name string) (suite Suite, err error) {
+	if name == "" {
+		name = SuiteNaCl
+	}
+	suites.RLock()
+	suite, ok := suites.m[name]
+	suites.RUnlock()
+	if !ok {
+		err = errors.Wrapf(ErrMalformed, "unknown suite '%s'", name)
+	}
+	return
+}
+
+// naclSuite is the original suite of the messages.
+type naclSuite struct{}
+
+func (naclSuite) Seal(plaintext []byte, key *[32]byte) ([]byte, error) {
+	return encryptWithSecret(plaintext, *key)
+}
+
+func (naclSuite) Open(ciphertext []byte, key *[32]byte) ([]byte, error) {
+	return decrypt(ciphertext, *key)
+}
+
+func (naclSuite) Wrap(messageKey []byte, shared keypair.SharedKey) ([]byte, error) {
+	return shared.Encrypt(messageKey)
+}
+
+func (naclSuite) Unwrap(wrapped []byte, shared keypair.SharedKey) ([]byte, error) {
+	return shared.Decrypt(wrapped)
+}
+
+func (naclSuite) Overhead() int {
+	return 24 + secretbox.Overhead
+}
+
+// xchachaSuite uses XChaCha20-Poly1305 with random 24 byte nonces.
+type xchachaSuite struct{}
+
+// xchachaWrapInfo is the HKDF info for the key wraps.
+const xchachaWrapInfo = "maildepot xchacha20poly1305 key wrap"
+
+func (xchachaSuite) Seal(plaintext []byte, key *[32]byte) (ciphertext []byte, err error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = io.ReadFull(crypto_rand.Reader, nonce); err != nil {
+		return
+	}
+	ciphertext = aead.Seal(nonce, nonce, plaintext, nil)
+	return
+}
+
+func (xchachaSuite) Open(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		err = errors.Wrap(ErrMalformed, "encrypted text is too short")
+		return
+	}
+	plaintext, err = aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		err = errors.Wrap(ErrTampered, "decryption failed")
+	}
+	return
+}
+
+func (s xchachaSuite) Wrap(messageKey []byte, shared keypair.SharedKey) (wrapped []byte, err error) {
+	key, err := shared.Derive(xchachaWrapInfo)
+	if err != nil {
+		return
+	}
+	return s.Seal(messageKey, &key)
+}
+
+func (s xchachaSuite) Unwrap(wrapped []byte, shared keypair.SharedKey) (messageKey []byte, err error) {
+	key, err := shared.Derive(xchachaWrapInfo)
+	if err != nil {
+		return
+	}
+	return s.Open(wrapped, &key)
+}
+
+func (xchachaSuite) Overhead() int {
+	return chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+}
@@ -0,0 +1,124 @@
+package mail
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/schollz/maildepot/keypair"
+)
+
+// WorldWraps are the message key wrapped for the recipients in one world,
+// with the tag of that world.
+type WorldWraps struct {
+	// World is the message ID encrypted by the world for itself
+	World string `json:"w"`
+	// Recipients are the message key encrypted by the world for each
+	// recipient
+	Recipients []string `json:"r"`
+}
+
+// allWorlds returns the wraps of the first world and of the others.
+func (m *Message) allWorlds() []WorldWraps {
+	return append([]WorldWraps{{World: m.World, Recipients: m.Recipients}}, m.Worlds...)
+}
+
+// wrapsFor returns the wraps that my keys should try. With the world
+// private key only the wraps of that world are tried, otherwise all of
+// them are.
+func (m *Message) wrapsFor(world *keypair.SharedKey) (wraps []string, err error) {
+	found := false
+	for _, w := range m.allWorlds() {
+		if world != nil && w.World != "" && !m.isSameWorld(w.World, *world) {
+			continue
+		}
+		found = true
+		wraps = append(wraps, w.Recipients...)
+	}
+	if !found {
+		err = ErrWrongWorld
+	}
+	return
+}
+
+// wrap encrypts the message key for the recipients of a world and tags
+// the message for that world. The message ID has to be final.
+func (m *Message) wrap(world keypair.KeyPair, suite Suite, secretKey [32]byte, recipients []string, o options) (w WorldWraps, err error) {
+	w.Recipients = make([]string, len(recipients), len(recipients)+o.dummyRecipients)
+	for i, recipientPublicKey := range recipients {
+		shared, err2 := world.Precompute(recipientPublicKey)
+		if err2 != nil {
+			err = errors.Wrap(err2, recipientPublicKey)
+			return
+		}
+		encrypted, err2 := suite.Wrap(secretKey[:], shared)
+		if err2 != nil {
+			err = errors.Wrap(err2, recipientPublicKey)
+			return
+		}
+		w.Recipients[i] = base64.StdEncoding.EncodeToString(encrypted)
+	}
+
+	// dummy recipients look like a wrapped key but are random
+	for i := 0; i < o.dummyRecipients; i++ {
+		dummy := make([]byte, len(secretKey)+suite.Overhead())
+		if _, err = io.ReadFull(crypto_rand.Reader, dummy); err != nil {
+			return
+		}
+		w.Recipients = append(w.Recipients, base64.StdEncoding.EncodeToString(dummy))
+	}
+	if o.shuffle {
+		err = shuffle(w.Recipients)
+		if err != nil {
+			return
+		}
+	}
+
+	tag, err := world.Encrypt([]byte(m.ID()), world.Public)
+	if err != nil {
+		return
+	}
+	w.World = base64.StdEncoding.EncodeToString(tag)
+	return
+}
+
+// Rewrap will return a copy of an opened message for the recipients of
+// another world, which is how a bridge moves messages between worlds.
+// Only the wraps and the world tag change, so the copy has the same ID as
+// the original. The stamp does not cover the new wraps, so the copy only
+// has one with WithStamp. Options for padding, compression or the suite
+// are ignored since the payload is not encrypted again.
+func (m Message) Rewrap(openMsg OpenMessage, world keypair.KeyPair, recipients []string, opts ...Option) (bridged Message, err error) {
+	suite, err := suiteByName(m.Suite)
+	if err != nil {
+		return
+	}
+	if openMsg.key == [32]byte{} {
+		err = errors.New("message key is unknown, the message has to be opened first")
+		return
+	}
+	// make sure the opened message is this message
+	encryptedSender, err := base64.StdEncoding.DecodeString(m.Sender)
+	if err != nil {
+		err = errors.Wrap(ErrMalformed, "sender is not decodable")
+		return
+	}
+	if _, err = suite.Open(encryptedSender, &openMsg.key); err != nil {
+		return
+	}
+
+	bridged = m
+	bridged.Worlds = nil
+	bridged.Stamp = ""
+	o := newOptions(opts)
+	w, err := bridged.wrap(world, suite, openMsg.key, recipients, o)
+	if err != nil {
+		return
+	}
+	bridged.World, bridged.Recipients = w.World, w.Recipients
+	if o.stamp > 0 {
+		err = bridged.Mint(o.stamp)
+	}
+	return
+}
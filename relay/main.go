@@ -1,25 +1,166 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/schollz/messagebox/keypair"
-	"github.com/schollz/messagebox/messagebox"
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
 )
 
-var world keypair.KeyPair
+// worlds are the worlds this relay knows, with the difficulty of the
+// postage stamps that each world requires
+var worlds = map[string]world{}
 
-func init() {
-	world, _ := keypair.NewDeterministic("world1")
-	log.Println(world)
+// defaultDifficulty is used for messages that are not from a known world
+var defaultDifficulty mail.Difficulty
+
+// authority is the base58 public key of the time authority
+var authority string
+
+// db stores the accepted messages by their digest, so a copy of a
+// message with the same ID can not replace it
+var db *depot.DB
+
+var dbName, listen, node string
+
+// peerSecret is the shared secret that the peers send to the depot handlers
+var peerSecret string
+
+// peers are the relays that the messages are synced with
+var peers []string
+
+const bucket = "mail"
+
+type world struct {
+	key        keypair.KeyPair
+	difficulty mail.Difficulty
+}
+
+// worldFile is a world in the file of -worlds. The private key is needed
+// to tell which messages belong to the world.
+type worldFile struct {
+	World      keypair.KeyPair `json:"world"`
+	Difficulty mail.Difficulty `json:"difficulty"`
+}
+
+// loadWorlds reads the key pairs of the worlds and their difficulties
+// from a JSON file.
+func loadWorlds(fname string) (err error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	var wfs []worldFile
+	if err = json.Unmarshal(b, &wfs); err != nil {
+		return
+	}
+	for _, wf := range wfs {
+		var key keypair.KeyPair
+		key, err = keypair.New(wf.World)
+		if err != nil {
+			return
+		}
+		if key.Private == "" {
+			err = fmt.Errorf("world %s has no private key", key.Public)
+			return
+		}
+		worlds[key.Public] = world{key: key, difficulty: wf.Difficulty}
+	}
+	return
+}
+
+// findWorld returns the world that the message belongs to. A message that
+// is in more than one world needs the largest difficulty of them.
+func findWorld(msg mail.Message) (w world, ok bool) {
+	for _, other := range worlds {
+		if msg.IsSameWorld(other.key) && (!ok || other.difficulty.Bits(msg) > w.difficulty.Bits(msg)) {
+			w, ok = other, true
+		}
+	}
+	return
 }
 
 func main() {
+	var base, perSize, perRecipient int
+	flag.IntVar(&base, "difficulty", 16, "bits of work required for every stamp")
+	flag.IntVar(&perSize, "difficulty-size", 1, "bits of work added for every doubling of message size above 1 kB")
+	flag.IntVar(&perRecipient, "difficulty-recipients", 1, "bits of work added for every doubling of recipients")
+	var worldsFile string
+	flag.StringVar(&worldsFile, "worlds", "", "JSON file of the key pairs of the worlds and their difficulties, instead of world1 with the flags")
+	flag.StringVar(&authority, "authority", "", "public key of the time authority")
+	flag.StringVar(&dbName, "db", "relay.db", "depot database for the messages")
+	flag.StringVar(&listen, "listen", ":8080", "address to listen on")
+	flag.StringVar(&node, "node", "", "name of this relay in the versions of what it stores, random if empty")
+	var peerList, peerListen string
+	var syncInterval, tombstoneHorizon, expireInterval time.Duration
+	flag.StringVar(&peerList, "peers", "", "comma separated URLs of the peer listeners of trusted relays to sync with")
+	flag.StringVar(&peerListen, "peer-listen", ":8081", "address to serve /depot/ to the peers on")
+	flag.StringVar(&peerSecret, "peer-secret", "", "shared secret of the peers, required with -peers")
+	flag.DurationVar(&syncInterval, "sync-interval", time.Minute, "time between syncs with the peers")
+	flag.DurationVar(&tombstoneHorizon, "tombstone-horizon", depot.DefaultTombstoneHorizon, "time that deleted messages are remembered for the peers")
+	flag.DurationVar(&expireInterval, "expire-interval", 10*time.Minute, "time between deletes of the expired messages")
+	var logSize uint64
+	flag.Uint64Var(&logSize, "log-size", depot.DefaultLogSize, "number of changes kept for the peers to catch up with")
+	flag.Parse()
+	if peerList != "" {
+		peers = strings.Split(peerList, ",")
+		if peerSecret == "" {
+			log.Fatal("-peers needs -peer-secret")
+		}
+	}
+	defaultDifficulty = mail.Difficulty{Base: base, PerSizeDoubling: perSize, PerRecipientDoubling: perRecipient}
+	if worldsFile != "" {
+		if err := loadWorlds(worldsFile); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		w, err := keypair.NewDeterministic("world1")
+		if err != nil {
+			log.Fatal(err)
+		}
+		worlds[w.Public] = world{key: w, difficulty: defaultDifficulty}
+	}
+
+	opts := []depot.Option{depot.WithLogSize(logSize)}
+	if node != "" {
+		opts = append(opts, depot.WithNode(node))
+	}
+	var err error
+	db, err = depot.New(dbName, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.NewBucket(bucket); err != nil {
+		log.Fatal(err)
+	}
+
+	go deleteExpired(expireInterval)
+
 	router := gin.Default()
 
+	if len(peers) > 0 {
+		// values set through sync are not checked, so only the peers can
+		// reach it, on its own listener and with the shared secret
+		mux := http.NewServeMux()
+		mux.Handle("/depot/", http.StripPrefix("/depot", authorized(depot.NewHandler(db))))
+		go func() {
+			log.Fatal(http.ListenAndServe(peerListen, mux))
+		}()
+		go syncPeers(syncInterval, tombstoneHorizon)
+	}
+
 	router.GET("/add/:hash", func(c *gin.Context) {
 		hash := c.Param("hash")
 
@@ -30,20 +171,151 @@ func main() {
 		}
 		defer r.Body.Close()
 
-		var msg messagebox.Message
+		var msg mail.Message
 		err = json.NewDecoder(r.Body).Decode(&msg)
 		if err != nil {
 			c.String(http.StatusOK, err.Error())
-		} else {
-			log.Println(msg.IsSameWorld(world))
-			c.JSON(200, msg)
+			return
+		}
+		accept(c, msg)
+	})
+
+	router.POST("/add", func(c *gin.Context) {
+		var msg mail.Message
+		if err := c.BindJSON(&msg); err != nil {
+			return
+		}
+		accept(c, msg)
+	})
+
+	router.GET("/difficulty", func(c *gin.Context) {
+		w, ok := worlds[c.Query("world")]
+		if !ok {
+			c.JSON(200, defaultDifficulty)
+			return
 		}
+		c.JSON(200, w.difficulty)
 	})
 
 	router.GET("/all", func(c *gin.Context) {
-		// return list of all hashes
-		c.String(http.StatusOK, "ok")
+		// return list of all messages
+		msgs, err := allMessages()
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(200, msgs)
 	})
 
-	router.Run(":8080")
+	router.Run(listen)
+}
+
+// check returns the status to refuse the message with, or 0 if the
+// relay can store it.
+func check(msg mail.Message) (status int, err error) {
+	if msg.IsExpired(authority, time.Now()) {
+		return http.StatusGone, mail.ErrExpired
+	}
+	difficulty := defaultDifficulty
+	if w, ok := findWorld(msg); ok {
+		difficulty = w.difficulty
+	}
+	if err = msg.CheckStamp(difficulty.Bits(msg)); err != nil {
+		status = http.StatusPaymentRequired
+	}
+	return
+}
+
+// accept checks the message and stores it.
+func accept(c *gin.Context, msg mail.Message) {
+	if status, err := check(msg); err != nil {
+		c.String(status, err.Error())
+		return
+	}
+	err := db.Set(bucket, msg.Digest(), msg)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(200, msg)
+}
+
+func allMessages() (msgs []mail.Message, err error) {
+	keys, err := db.GetKeysInRange(bucket, "first", "last")
+	if err != nil {
+		return
+	}
+	msgs = make([]mail.Message, 0, len(keys))
+	for _, key := range keys {
+		var msg mail.Message
+		err = db.Get(bucket, key, &msg)
+		if err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// deleteExpired deletes the expired messages, forever.
+func deleteExpired(interval time.Duration) {
+	for {
+		deleted, err := db.DeleteExpired(bucket, mail.Expired(authority, time.Now()))
+		if err != nil {
+			log.Printf("delete expired: %s", err)
+		} else if deleted > 0 {
+			log.Printf("deleted %d expired messages", deleted)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// authorized lets through the requests that have the shared secret.
+func authorized(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+peerSecret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// bearer adds the shared secret to the requests to the peers.
+type bearer struct {
+	next http.RoundTripper
+}
+
+func (b bearer) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+peerSecret)
+	return b.next.RoundTrip(r)
+}
+
+// peerClient sends requests to the peers.
+var peerClient = &http.Client{Transport: bearer{http.DefaultTransport}, Timeout: time.Minute}
+
+// syncPeers pulls the changes of every peer, forever, and forgets the
+// deletes older than the horizon.
+func syncPeers(interval, horizon time.Duration) {
+	since := make(map[string]uint64)
+	for {
+		if _, err := db.DeleteTombstones(bucket, horizon); err != nil {
+			log.Printf("delete tombstones: %s", err)
+		}
+		for _, peer := range peers {
+			remote := depot.NewHTTPPeer(peer+"/depot", peerClient)
+			stats, seq, err := depot.SyncChanges(context.Background(), bucket, db, remote, since[peer])
+			if err != nil {
+				log.Printf("sync with %s: %s", peer, err)
+				continue
+			}
+			since[peer] = seq
+			if stats.Pulled > 0 || stats.Pushed > 0 {
+				log.Printf("sync with %s: %+v", peer, stats)
+			}
+		}
+		time.Sleep(interval)
+	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorlds(t *testing.T) {
+	world1, _ := keypair.New()
+	world2, _ := keypair.New()
+	bob, _ := keypair.New()
+
+	b, _ := json.Marshal([]worldFile{
+		{World: world1, Difficulty: mail.Difficulty{Base: 12}},
+		{World: world2, Difficulty: mail.Difficulty{Base: 2}},
+	})
+	f, _ := ioutil.TempFile("", "worlds")
+	defer os.Remove(f.Name())
+	f.Write(b)
+	f.Close()
+	assert.Nil(t, loadWorlds(f.Name()))
+	defaultDifficulty = mail.Difficulty{Base: 4}
+
+	// a stamp that is enough for the default is not enough for world1
+	msg, err := mail.New(world1, bob, []string{bob.Public}, []byte("hello, world"), mail.WithStamp(4))
+	assert.Nil(t, err)
+	for msg.CheckStamp(12) == nil {
+		msg, _ = mail.New(world1, bob, []string{bob.Public}, []byte("hello, world"), mail.WithStamp(4))
+	}
+	status, err := check(msg)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusPaymentRequired, status)
+	msg, _ = mail.New(world1, bob, []string{bob.Public}, []byte("hello, world"), mail.WithStamp(12))
+	_, err = check(msg)
+	assert.Nil(t, err)
+
+	// other worlds need the default
+	other, _ := keypair.New()
+	msg, _ = mail.New(other, bob, []string{bob.Public}, []byte("hello, world"))
+	_, err = check(msg)
+	assert.NotNil(t, err)
+	msg, _ = mail.New(world2, bob, []string{bob.Public}, []byte("hello, world"), mail.WithStamp(2))
+	_, err = check(msg)
+	assert.Nil(t, err)
+
+	// a world without its private key can not be recognized
+	b, _ = json.Marshal([]worldFile{{World: keypair.KeyPair{Public: world1.Public}}})
+	ioutil.WriteFile(f.Name(), b, 0644)
+	assert.NotNil(t, loadWorlds(f.Name()))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/eml"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+)
+
+// gateway accepts email over SMTP, wraps it into messages from the sender
+// and deposits them into the depot.
+type gateway struct {
+	world  keypair.KeyPair
+	sender keypair.KeyPair
+	book   eml.AddressBook
+	db     *depot.DB
+	bucket string
+	opts   []mail.Option
+}
+
+// NewSession is called for every SMTP connection.
+func (g *gateway) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{g: g}, nil
+}
+
+type session struct {
+	g    *gateway
+	from string
+	to   []string
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+// Rcpt only accepts addresses that have a public key.
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if _, ok := s.g.book.Lookup(to); !ok {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "no public key for " + to,
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msgs, err := s.g.deliver(s.to, raw)
+	if err != nil {
+		log.Println(err)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	log.Printf("deposited %d messages from %s", len(msgs), s.from)
+	return nil
+}
+
+// deliver wraps the email for the envelope recipients and deposits the
+// messages. Envelope recipients that are not in To or Cc get a blind copy.
+func (g *gateway) deliver(rcpts []string, raw []byte) (msgs []mail.Message, err error) {
+	p, h, err := eml.Parse(bytes.NewReader(raw), g.book)
+	if err != nil {
+		return
+	}
+	if p.Date.IsZero() {
+		p.Date = time.Now().UTC()
+	}
+
+	envelope := make(map[string]bool)
+	for _, rcpt := range rcpts {
+		publicKey, _ := g.book.Lookup(rcpt)
+		envelope[publicKey] = true
+	}
+	visible := make(map[string]bool)
+	filter := func(keys []string) (filtered []string) {
+		for _, key := range keys {
+			if envelope[key] && !visible[key] {
+				visible[key] = true
+				filtered = append(filtered, key)
+			}
+		}
+		return
+	}
+	header := mail.Header{To: filter(h.To), Cc: filter(h.Cc)}
+	for key := range envelope {
+		if !visible[key] {
+			header.Bcc = append(header.Bcc, key)
+		}
+	}
+
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	msgs, err = mail.NewWithHeader(g.world, g.sender, header, payload, g.opts...)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		err = g.db.Set(g.bucket, msg.ID(), msg)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/emersion/go-smtp"
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/eml"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+)
+
+func main() {
+	var listen, dbName, bucket, bookFile, senderFile, worldPassphrase string
+	var padding bool
+	flag.StringVar(&listen, "listen", "127.0.0.1:2525", "address to listen on")
+	flag.StringVar(&dbName, "db", "maildepot.db", "depot database")
+	flag.StringVar(&bucket, "bucket", "mail", "depot bucket for messages")
+	flag.StringVar(&bookFile, "addresses", "addresses.json", "JSON file mapping email addresses to public keys")
+	flag.StringVar(&senderFile, "sender", "sender.json", "JSON file with the key pair of the sender")
+	flag.StringVar(&worldPassphrase, "world", "world1", "passphrase of the world key")
+	flag.BoolVar(&padding, "pad", true, "pad and compress messages")
+	flag.Parse()
+
+	world, err := keypair.NewDeterministic(worldPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sender keypair.KeyPair
+	if err = readJSON(senderFile, &sender); err != nil {
+		log.Fatal(err)
+	}
+	sender, err = keypair.New(sender)
+	if err != nil {
+		log.Fatal(err)
+	}
+	book := eml.AddressBook{}
+	if err = readJSON(bookFile, &book); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := depot.New(dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.NewBucket(bucket); err != nil {
+		log.Fatal(err)
+	}
+
+	g := &gateway{
+		world:  world,
+		sender: sender,
+		book:   book,
+		db:     db,
+		bucket: bucket,
+	}
+	if padding {
+		g.opts = []mail.Option{mail.WithCompression(mail.CompressZstd), mail.WithPadding(mail.PadPadme)}
+	}
+
+	s := smtp.NewServer(g)
+	s.Addr = listen
+	s.Domain = "localhost"
+	s.MaxMessageBytes = 16 << 20
+	s.MaxRecipients = 100
+	log.Printf("listening on %s", listen)
+	log.Fatal(s.ListenAndServe())
+}
+
+func readJSON(fname string, v interface{}) (err error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(b, v)
+}
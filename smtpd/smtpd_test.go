@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/smtp"
+	"os"
+	"testing"
+
+	go_smtp "github.com/emersion/go-smtp"
+	"github.com/schollz/maildepot/depot"
+	"github.com/schollz/maildepot/eml"
+	"github.com/schollz/maildepot/keypair"
+	"github.com/schollz/maildepot/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGateway(t *testing.T) {
+	os.Remove("smtpd.db")
+	defer os.Remove("smtpd.db")
+	db, err := depot.New("smtpd.db")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.NewBucket("mail"))
+
+	world, _ := keypair.New()
+	sender, _ := keypair.New()
+	jane, _ := keypair.New()
+	jeff, _ := keypair.New()
+	g := &gateway{
+		world:  world,
+		sender: sender,
+		book: eml.AddressBook{
+			"jane@example.com": jane.Public,
+			"jeff@example.com": jeff.Public,
+		},
+		db:     db,
+		bucket: "mail",
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := go_smtp.NewServer(g)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	body := "To: jane@example.com\r\nSubject: hello\r\n\r\nhello, world\r\n"
+	err = smtp.SendMail(l.Addr().String(), nil, "app@example.com", []string{"jane@example.com", "jeff@example.com"}, []byte(body))
+	assert.Nil(t, err)
+
+	// one message for jane and a blind copy for jeff
+	keys, err := db.GetKeysInRange("mail", "first", "last")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+	opened := 0
+	for _, key := range keys {
+		var msg mail.Message
+		assert.Nil(t, db.Get("mail", key, &msg))
+		openMsg, err := msg.Open(world, []keypair.KeyPair{jane, jeff})
+		assert.Nil(t, err)
+		assert.Equal(t, sender.Public, openMsg.Sender)
+		raw, err := eml.Export(openMsg, g.book)
+		assert.Nil(t, err)
+		p, _, err := eml.Parse(bytes.NewReader(raw), g.book)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", p.Subject)
+		if len(openMsg.Header.Bcc) > 0 {
+			assert.Equal(t, []string{jeff.Public}, openMsg.Header.Bcc)
+		}
+		opened++
+	}
+	assert.Equal(t, 2, opened)
+
+	// addresses in the header that are not in the address book are left out
+	body = "To: jane@example.com\r\nCc: someone@elsewhere.com\r\nSubject: hello\r\n\r\nhello, world\r\n"
+	msgs, err := g.deliver([]string{"jane@example.com"}, []byte(body))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+
+	// unknown recipients are refused
+	err = smtp.SendMail(l.Addr().String(), nil, "app@example.com", []string{"nobody@example.com"}, []byte(body))
+	assert.NotNil(t, err)
+}
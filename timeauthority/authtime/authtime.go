@@ -0,0 +1,72 @@
+package authtime
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/nacl/sign"
+)
+
+// Layout is the layout of the time signed by the time authority.
+const Layout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Sign returns the time signed by the private key of the time authority.
+func Sign(t time.Time, privateKey *[64]byte) (authenticatedTime string) {
+	signedMessage := sign.Sign(nil, []byte(t.UTC().Format(Layout)), privateKey)
+	authenticatedTime = base58.FastBase58Encoding(signedMessage)
+	return
+}
+
+// Open returns the signed time string if it was signed by the time
+// authority with the given base58 public key.
+func Open(authenticatedTime string, publicKey string) (actualTime string, err error) {
+	publicKeyBytes, err := base58.FastBase58Decoding(publicKey)
+	if err != nil {
+		return
+	}
+	if len(publicKeyBytes) != 32 {
+		err = errors.New("bad time authority key")
+		return
+	}
+	var pub [32]byte
+	copy(pub[:], publicKeyBytes)
+
+	signedMessage, err := base58.FastBase58Decoding(authenticatedTime)
+	if err != nil {
+		return
+	}
+	message, ok := sign.Open(nil, signedMessage, &pub)
+	if !ok {
+		err = errors.New("failed to authenticate")
+		return
+	}
+	actualTime = string(message)
+	return
+}
+
+// Authenticate returns the time if it was signed by the time authority
+// with the given base58 public key.
+func Authenticate(authenticatedTime string, publicKey string) (t time.Time, err error) {
+	actualTime, err := Open(authenticatedTime, publicKey)
+	if err != nil {
+		return
+	}
+	t, err = time.Parse(Layout, actualTime)
+	return
+}
+
+// Parse returns the time in an authenticated time without checking the
+// signature, for when the time authority key is not known.
+func Parse(authenticatedTime string) (t time.Time, err error) {
+	signedMessage, err := base58.FastBase58Decoding(authenticatedTime)
+	if err != nil {
+		return
+	}
+	if len(signedMessage) < sign.Overhead {
+		err = errors.New("authenticated time is too short")
+		return
+	}
+	t, err = time.Parse(Layout, string(signedMessage[sign.Overhead:]))
+	return
+}
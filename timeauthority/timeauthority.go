@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/rand"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -14,6 +13,7 @@ import (
 	"time"
 
 	"github.com/mr-tron/base58/base58"
+	"github.com/schollz/maildepot/timeauthority/authtime"
 	"golang.org/x/crypto/nacl/sign"
 )
 
@@ -21,27 +21,15 @@ var publicKey [32]byte
 var privateKey [64]byte
 
 func signTime() (authenticatedTime string) {
-	signedMessage := sign.Sign(nil, []byte(time.Now().UTC().String()), &privateKey)
-	authenticatedTime = base58.FastBase58Encoding(signedMessage)
-	return
+	return authtime.Sign(time.Now(), &privateKey)
 }
 
 func authenticateSignedTime(authenticatedTime string) (actualTime string, err error) {
-	signedMessage, err := base58.FastBase58Decoding(authenticatedTime)
-	if err != nil {
-		return
-	}
-	message, ok := sign.Open(nil, signedMessage, &publicKey)
-	if !ok {
-		err = errors.New("failed to authenticate")
-		return
-	}
-	actualTime = string(message)
-	return
+	return authtime.Open(authenticatedTime, base58.FastBase58Encoding(publicKey[:]))
 }
 
 func handlerSlash(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, `Time Authority API:
+	fmt.Fprint(w, `Time Authority API:
 		
 GET /now - returns the authenticated time 
 